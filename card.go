@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/go-telegram/ui/datepicker"
+	"github.com/go-telegram/ui/keyboard/inline"
+)
+
+// the wizard keeps one "form card" message: the fields filled so far and the current question with its keyboard.
+// every button step edits the card, only free-text prompts go as new messages
+
+// go-telegram/ui keyboards unregister their callback handler only when they delete their message, which the card
+// never lets them do. so the card remembers the handler of the keyboard it shows and unregisters it once replaced
+var (
+	cardHandlersMutex sync.Mutex
+	cardHandlers      = make(map[int64]string) // callback handler ID of the keyboard on the card, per chat
+)
+
+// widgetHandlerID reads the callback handler ID of an inline keyboard or a datepicker, the widgets keep it unexported
+func widgetHandlerID(markup models.ReplyMarkup) string {
+	v := reflect.ValueOf(markup)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return ""
+	}
+	id := v.Elem().FieldByName("callbackHandlerID")
+	if id.Kind() != reflect.String {
+		return ""
+	}
+	return id.String()
+}
+
+// setCardHandler unregisters the handler of the keyboard the card showed before and remembers id in its place
+func setCardHandler(b *bot.Bot, chatID int64, id string) {
+	cardHandlersMutex.Lock()
+	defer cardHandlersMutex.Unlock()
+
+	if old, ok := cardHandlers[chatID]; ok && old != id {
+		b.UnregisterHandler(old)
+	}
+	if id == "" {
+		delete(cardHandlers, chatID)
+	} else {
+		cardHandlers[chatID] = id
+	}
+}
+
+// formCardString lists the fields of the form being filled, in wizard order. unfilled fields are left out
+func formCardString(session Session, form Form) string {
+	title := "📝 Новый запрос"
+	if session.Editing {
+		title = fmt.Sprintf("✏️ Изменение формы %d", session.EditingFormID)
+	}
+	// the summary and the closed card show every setting of the complete form
+	if form.Validate() == nil {
+		return title + "\n" + formToString(form)
+	}
+
+	lines := []string{title}
+	if form.DeparturePoint != "" || form.ArrivalPoint != "" {
+		lines = append(lines, fmt.Sprintf("Маршрут: %s → %s", form.DeparturePoint, form.ArrivalPoint))
+	}
+	if !form.DepartureDate.IsZero() {
+		lines = append(lines, "Дата: "+formDatesString(form))
+	}
+	if form.RoundTrip && !form.ReturnDate.IsZero() {
+		lines = append(lines, "Обратно: "+formatDateWithWeekday(form.ReturnDate))
+		if form.RoundTripBudget > 0 {
+			lines = append(lines, fmt.Sprintf("Бюджет туда-обратно: %d ₽", form.RoundTripBudget))
+		}
+	}
+	if form.CarriageType != "" {
+		lines = append(lines, "Вагон: "+form.CarriageType.Label())
+	}
+	if form.NumberOfPassengers > 0 {
+		lines = append(lines, fmt.Sprintf("Пассажиров: %d", form.NumberOfPassengers))
+	}
+	if len(form.CompartmentNumber) > 0 {
+		lines = append(lines, "Отсек: "+compartmentNumberToString(form.CompartmentNumber))
+	}
+	if form.ShelfType == ShelfAny {
+		lines = append(lines, "Места: любые")
+	} else if form.ShelfType != "" {
+		shelves := fmt.Sprintf("Полки: нижних %d, верхних %d", form.NumberOfPassengersBottomShefl, form.NumberOfPassengersTopShefl)
+		if form.NumberOfPassengersSideShefl > 0 {
+			shelves += fmt.Sprintf(", боковых %d", form.NumberOfPassengersSideShefl)
+		}
+		lines = append(lines, shelves)
+	}
+	if hasTrainFilters(form) {
+		lines = append(lines, "Фильтры поездов: есть")
+	}
+	if form.TrackPriceChange {
+		lines = append(lines, "Отслеживать цену")
+	}
+	if form.PriceCeiling > 0 {
+		lines = append(lines, fmt.Sprintf("Не дороже %d ₽ %s", form.PriceCeiling, priceCeilingUnit(form)))
+	}
+	if form.SuggestSimilarSeats {
+		lines = append(lines, "Предлагать похожие места")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// showCard puts the filled fields, the question and the keyboard on the card of the chat.
+// a new card is sent if there is none yet or the old one can not be edited
+func showCard(ctx context.Context, b *bot.Bot, chatID int64, question string, markup models.ReplyMarkup) {
+	// the keyboard replaces the previous one on the card, or is dropped if the card could not be shown
+	shown := false
+	defer func() {
+		if shown {
+			setCardHandler(b, chatID, widgetHandlerID(markup))
+		} else if id := widgetHandlerID(markup); id != "" {
+			b.UnregisterHandler(id)
+		}
+	}()
+
+	session, err := getSession(chatID)
+	if err != nil {
+		log.Println("Error: card: could not get session: ", err)
+		return
+	}
+	form, err := getLastForm(chatID)
+	if err != nil {
+		log.Println("Error: card: could not get last(current) form: ", err)
+		return
+	}
+
+	text := formCardString(session, form)
+	if question != "" {
+		text += "\n\n" + question
+	}
+
+	if err := sendLimiter.Wait(ctx, chatID); err != nil {
+		return
+	}
+
+	if session.CardMessageID != 0 {
+		_, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+			ChatID:      chatID,
+			MessageID:   session.CardMessageID,
+			Text:        text,
+			ReplyMarkup: markup,
+		})
+		if err == nil || strings.Contains(err.Error(), "message is not modified") {
+			shown = true
+			return
+		}
+		log.Printf("Card: could not edit card %d of chat %d, sending a new one: %v", session.CardMessageID, chatID, err)
+	}
+
+	msg, err := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:      chatID,
+		Text:        text,
+		ReplyMarkup: markup,
+	})
+	if err != nil {
+		log.Printf("Error: could not send card to chat %d: %v", chatID, err)
+		return
+	}
+	shown = true
+	updateSession(chatID, SessionUpdate{CardMessageID: &msg.ID})
+}
+
+// like sendButtonList, but on the card
+func sendCardButtonList(ctx context.Context, b *bot.Bot, update *models.Update, names []string, text string, onSelect inline.OnSelect) {
+	kb := inline.New(b, inline.NoDeleteAfterClick())
+
+	for _, name := range names {
+		kb.Row().Button(name, []byte(name), onSelect)
+	}
+
+	showCard(ctx, b, update.Message.Chat.ID, text, kb)
+}
+
+// like sendEnumButtonList, but on the card
+func sendCardEnumButtonList[T ~string](ctx context.Context, b *bot.Bot, update *models.Update, values []T, label func(T) string, text string, onSelect inline.OnSelect) {
+	kb := inline.New(b, inline.NoDeleteAfterClick())
+
+	for _, value := range values {
+		kb.Row().Button(label(value), []byte(value), onSelect)
+	}
+
+	showCard(ctx, b, update.Message.Chat.ID, text, kb)
+}
+
+// like sendDatePicker, but on the card. the picker must not delete the card after a click,
+// onCancel shows the previous question again
+func sendCardDatePicker(ctx context.Context, b *bot.Bot, update *models.Update, text string, onSelect datepicker.OnSelectHandler, onCancel datepicker.OnCancelHandler, opts ...datepicker.Option) {
+	opts = append(opts, datepicker.NoDeleteAfterSelect(), datepicker.NoDeleteAfterCancel(), datepicker.OnCancel(onCancel))
+	kb := datepicker.New(b, onSelect, opts...)
+
+	showCard(ctx, b, update.Message.Chat.ID, text, kb)
+}
+
+// sendCardPrompt updates the card without a keyboard and asks for free text in a new message
+func sendCardPrompt(ctx context.Context, b *bot.Bot, update *models.Update, text string) {
+	showCard(ctx, b, update.Message.Chat.ID, "", nil)
+	sendMessage(ctx, b, update, text)
+}
+
+// closeCard leaves the final text of form on the card, without a keyboard, and forgets the card.
+// without a card the text goes as a new message
+func closeCard(ctx context.Context, b *bot.Bot, chatID int64, form Form, text string) {
+	setCardHandler(b, chatID, "")
+
+	session, err := getSession(chatID)
+	if err != nil {
+		log.Println("Error: card: could not get session: ", err)
+		return
+	}
+	if session.CardMessageID != 0 {
+		updateSession(chatID, SessionUpdate{CardMessageID: intPtr(0)})
+
+		if err := sendLimiter.Wait(ctx, chatID); err != nil {
+			return
+		}
+		_, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+			ChatID:    chatID,
+			MessageID: session.CardMessageID,
+			Text:      formCardString(session, form) + "\n\n" + text,
+		})
+		if err == nil {
+			return
+		}
+		log.Printf("Card: could not close card %d of chat %d: %v", session.CardMessageID, chatID, err)
+	}
+
+	if err := sendChatMessage(ctx, b, chatID, text, false); err != nil {
+		log.Printf("Error: could not send message to chat %d: %v", chatID, err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/go-telegram/ui/datepicker"
+	"github.com/go-telegram/ui/keyboard/inline"
+)
+
+func TestWidgetHandlerID(t *testing.T) {
+	b, err := bot.New("test", bot.WithSkipGetMe())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if id := widgetHandlerID(inline.New(b)); id == "" {
+		t.Error("no handler ID for an inline keyboard")
+	}
+	if id := widgetHandlerID(datepicker.New(b, func(context.Context, *bot.Bot, models.MaybeInaccessibleMessage, time.Time) {})); id == "" {
+		t.Error("no handler ID for a datepicker")
+	}
+	if id := widgetHandlerID(nil); id != "" {
+		t.Errorf("handler ID %q for no keyboard", id)
+	}
+	if id := widgetHandlerID(&models.InlineKeyboardMarkup{}); id != "" {
+		t.Errorf("handler ID %q for a plain markup", id)
+	}
+}
+
+func TestSetCardHandlerUnregistersReplacedKeyboard(t *testing.T) {
+	unhandled := 0
+	b, err := bot.New("test", bot.WithSkipGetMe(), bot.WithNotAsyncHandlers(), bot.WithDefaultHandler(func(context.Context, *bot.Bot, *models.Update) {
+		unhandled++
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const chatID = 1
+	clicked := false
+	old := inline.New(b, inline.NoDeleteAfterClick())
+	old.Row().Button("old", []byte("old"), func(context.Context, *bot.Bot, models.MaybeInaccessibleMessage, []byte) {
+		clicked = true
+	})
+	setCardHandler(b, chatID, widgetHandlerID(old))
+	setCardHandler(b, chatID, widgetHandlerID(inline.New(b, inline.NoDeleteAfterClick())))
+
+	b.ProcessUpdate(context.Background(), &models.Update{CallbackQuery: &models.CallbackQuery{Data: old.Prefix() + "0"}})
+	if clicked || unhandled != 1 {
+		t.Errorf("click on the replaced keyboard: clicked %v, unhandled %d", clicked, unhandled)
+	}
+
+	setCardHandler(b, chatID, "")
+	if _, ok := cardHandlers[chatID]; ok {
+		t.Error("closed card still has a handler")
+	}
+}
+
+func TestFormCardStringOfCompleteForm(t *testing.T) {
+	useTestCities(t)
+
+	form := testForm(4)
+	form.CarriageType, form.CompartmentNumber, form.NoSideShefl = CarriagePlackart, allCompartments(CarriagePlackart), true
+	form.TrackPriceChange, form.ChangeThreshold, form.ChangeThresholdPercent, form.ChangeDirection = true, 10, true, ChangeDrop
+	form.TrainNumbers = []string{"020У"}
+	text := formCardString(Session{}, form)
+	for _, want := range []string{"📝 Новый запрос", "Без боковых мест", "Поезда: 020У", "(от 10 %)", strings.ToLower(ChangeDrop.Label())} {
+		if !strings.Contains(text, want) {
+			t.Errorf("card of the complete form has no %q:\n%s", want, text)
+		}
+	}
+
+	// while the wizard fills the form only the fields set so far are listed
+	text = formCardString(Session{}, Form{DeparturePoint: "Москва", ArrivalPoint: "Казань"})
+	if text != "📝 Новый запрос\nМаршрут: Москва → Казань" {
+		t.Errorf("card of the incomplete form: %q", text)
+	}
+}
@@ -2,8 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger/v4"
 )
@@ -12,6 +18,20 @@ func getDBKey(chatID int64) []byte {
 	return []byte(fmt.Sprintf("%d", chatID))
 }
 
+// how many times a transaction is run while it conflicts with concurrent ones
+const maxTxnAttempts = 5
+
+// runs fn in a read-write transaction. badger refuses to commit a transaction if another one changed the keys it read
+// meanwhile, then fn runs again on the fresh values
+func updateDB(fn func(txn *badger.Txn) error) error {
+	for attempt := 1; ; attempt++ {
+		err := db.Update(fn)
+		if err != badger.ErrConflict || attempt == maxTxnAttempts {
+			return err
+		}
+	}
+}
+
 // ---- sessions ----
 // checks if user has forms
 func userHasSession(chatID int64) (bool, error) {
@@ -38,6 +58,11 @@ func createSession(chatID int64) error {
 		Forms:   []Form{},
 	}
 
+	if err := session.Validate(); err != nil {
+		log.Println("Error: refusing to store invalid session: ", err)
+		return err
+	}
+
 	jsn, err := json.Marshal(session)
 	if err != nil {
 		log.Println("Error: marshaling new session: ", err)
@@ -74,170 +99,931 @@ func getSession(chatID int64) (Session, error) {
 		return Session{}, err
 	}
 
+	if err := session.Validate(); err != nil {
+		log.Printf("Error: loaded invalid session of chat %d: %v", chatID, err)
+		return quarantineInvalidForms(chatID)
+	}
+
 	return session, nil
 }
 
 func updateSession(chatID int64, update SessionUpdate) error {
+	err := changeSession(chatID, func(txn *badger.Txn, session *Session) error {
+		if update.Step != nil {
+			session.Step = *update.Step
+		}
+		if update.Command != nil {
+			session.Command = *update.Command
+		}
+		if update.Timezone != nil {
+			session.Timezone = *update.Timezone
+		}
+		if update.QuietHours != nil {
+			session.QuietHours = *update.QuietHours
+		}
+		if update.QuietMode != nil {
+			session.QuietMode = *update.QuietMode
+		}
+		if update.DigestMode != nil {
+			session.DigestMode = *update.DigestMode
+		}
+		if update.DigestEvery != nil {
+			session.DigestEvery = *update.DigestEvery
+		}
+		if update.CardMessageID != nil {
+			session.CardMessageID = *update.CardMessageID
+		}
+		if update.StatusMessageID != nil {
+			session.StatusMessageID = *update.StatusMessageID
+		}
+		if update.Editing != nil {
+			session.Editing = *update.Editing
+		}
+		if update.EditingFormID != nil {
+			session.EditingFormID = *update.EditingFormID
+		}
+		if update.EditingField != nil {
+			session.EditingField = *update.EditingField
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Error: updating session in DB: ", err)
+		return err
+	}
+
+	return nil
+}
+
+var sessionWriteMutex sync.Mutex
+
+// returned by the change of changeSession to leave the session as it is, without writing it
+var errNothingToChange = errors.New("nothing to change")
+
+// reads, changes and stores the session of the chat in one transaction, so concurrent writers never overwrite each
+// other. change may run more than once and must only work on the session it is given. an invalid result is not stored
+func changeSession(chatID int64, change func(txn *badger.Txn, session *Session) error) error {
 	key := getDBKey(chatID)
-	var session Session
 
-	err := db.View(func(txn *badger.Txn) error {
+	// session writers wait for each other instead of retrying, the bot, the monitors and the outbox write at once
+	sessionWriteMutex.Lock()
+	defer sessionWriteMutex.Unlock()
+
+	return updateDB(func(txn *badger.Txn) error {
+		var session Session
 		item, err := txn.Get(key)
 		if err != nil {
 			return err
 		}
-		return item.Value(func(val []byte) error {
+		err = item.Value(func(val []byte) error {
 			return json.Unmarshal(val, &session)
 		})
+		if err != nil {
+			return err
+		}
+
+		if err := change(txn, &session); err != nil {
+			return err
+		}
+
+		if err := session.Validate(); err != nil {
+			log.Println("Error: refusing to store invalid session: ", err)
+			return err
+		}
+
+		jsn, err := json.Marshal(session)
+		if err != nil {
+			return err
+		}
+		return txn.Set(key, jsn)
+	})
+}
+
+// ---- migrations ----
+
+// compartments the "Любой" and "Не боковой" presets stored before the carriage layouts
+var legacyAnyCompartments = []int{1, 2, 3, 4, 5, 6, 8, 9}
+var legacyNotSideCompartments = []int{2, 3, 4, 5, 6, 8}
+
+// button labels that were stored as CarriageType and ShelfType before the enums
+var legacyCarriageTypes = map[string]CarriageType{"Любой": CarriageAny, "Плацкарт": CarriagePlackart, "Купе": CarriageKupe}
+var legacyShelfTypes = map[string]ShelfType{"Любое": ShelfAny, "Указать нижние": ShelfBottom, "Указать верхние": ShelfTop}
+
+// migrateForm converts the legacy fields of a stored form, reports if anything changed
+func migrateForm(form *Form) bool {
+	migrated := false
+	if carriageType, ok := legacyCarriageTypes[string(form.CarriageType)]; ok {
+		form.CarriageType = carriageType
+		migrated = true
+	}
+	if shelfType, ok := legacyShelfTypes[string(form.ShelfType)]; ok {
+		form.ShelfType = shelfType
+		migrated = true
+	}
+	switch {
+	case slices.Equal(form.CompartmentNumber, legacyAnyCompartments):
+		form.CompartmentNumber = allCompartments(form.CarriageType)
+		migrated = true
+	case slices.Equal(form.CompartmentNumber, legacyNotSideCompartments):
+		form.CompartmentNumber = allCompartments(form.CarriageType)
+		form.NoSideShefl = hasSideBerths(form.CarriageType) && form.NumberOfPassengersSideShefl == 0
+		migrated = true
+	}
+	return migrated
+}
+
+// brings every stored session to the current format, runs on startup before anything reads them
+func migrateSessions() error {
+	return db.Update(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			chatID, err := strconv.ParseInt(string(item.Key()), 10, 64)
+			if err != nil {
+				continue // not a session
+			}
+
+			var session Session
+			err = item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &session)
+			})
+			if err != nil {
+				log.Printf("Error: could not unmarshal session of chat %d while migrating: %v", chatID, err)
+				continue
+			}
+
+			migrated := false
+			for i := range session.Forms {
+				if migrateForm(&session.Forms[i]) {
+					migrated = true
+				}
+			}
+			if session.NextFormID == 0 {
+				next, err := usedFormIDsEnd(txn, chatID, session)
+				if err != nil {
+					return err
+				}
+				if next > 0 {
+					session.NextFormID = next
+					migrated = true
+				}
+			}
+			if !migrated {
+				continue
+			}
+
+			jsn, err := json.Marshal(session)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(item.KeyCopy(nil), jsn); err != nil {
+				return err
+			}
+			log.Printf("Migrated forms of chat %d", chatID)
+		}
+		return nil
+	})
+}
+
+// usedFormIDsEnd is one above the highest form ID of the session, its archive and its quarantine, for sessions
+// stored before NextFormID
+func usedFormIDsEnd(txn *badger.Txn, chatID int64, session Session) (int, error) {
+	next := nextFormID(session)
+	for _, key := range [][]byte{getArchiveDBKey(chatID), getQuarantineDBKey(chatID)} {
+		// archived and quarantined records both keep the form in their Form field
+		var records []struct{ Form Form }
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		err = item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &records)
+		})
+		if err != nil {
+			return 0, err
+		}
+		for _, record := range records {
+			next = max(next, record.Form.ID+1)
+		}
+	}
+	return next, nil
+}
+
+// ---- quarantine ----
+
+// key: "quarantine:<chatID>", value: []QuarantinedForm in json
+func getQuarantineDBKey(chatID int64) []byte {
+	return []byte(fmt.Sprintf("quarantine:%d", chatID))
+}
+
+// moves the forms that break invariants out of the session into the quarantine record, resets the broken settings,
+// and stores the cleaned session. the monitors of the quarantined forms are stopped
+func quarantineInvalidForms(chatID int64) (Session, error) {
+	var cleaned Session
+	var quarantined []QuarantinedForm
+	var stopped []int
+	quarantineKey := getQuarantineDBKey(chatID)
+
+	err := changeSession(chatID, func(txn *badger.Txn, session *Session) error {
+		if !contains(validCommands, session.Command) || session.Step < 0 {
+			log.Printf("Quarantine: resetting command %q step %d of chat %d", session.Command, session.Step, chatID)
+			session.Command = "none"
+			session.Step = 0
+		}
+		if session.Timezone != "" {
+			if _, err := time.LoadLocation(session.Timezone); err != nil {
+				log.Printf("Quarantine: resetting unknown timezone %q of chat %d to %s", session.Timezone, chatID, defaultTimezone)
+				session.Timezone = ""
+			}
+		}
+		if (session.QuietMode != "" && !contains(quietModes, session.QuietMode)) || (session.DigestMode != "" && !contains(digestModes, session.DigestMode)) || (session.DigestMode == DigestInterval && session.DigestEvery <= 0) {
+			log.Printf("Quarantine: resetting notification settings of chat %d", chatID)
+			session.QuietMode = ""
+			session.DigestMode = DigestOff
+			session.DigestEvery = 0
+		}
+
+		quarantined, stopped = nil, nil
+		forms := []Form{}
+		ids := map[int]bool{}
+		for i, form := range session.Forms {
+			complete := session.Command == "none" || i != len(session.Forms)-1
+			err := form.validate(complete)
+			if err == nil && ids[form.ID] {
+				err = ValidationError{{Field: "ID", Message: fmt.Sprintf("duplicate id %d", form.ID)}}
+			}
+			if err != nil {
+				log.Printf("Quarantine: form %d of chat %d: %v", form.ID, chatID, err)
+				quarantined = append(quarantined, QuarantinedForm{Form: form, Error: err.Error(), Time: time.Now()})
+				continue
+			}
+			ids[form.ID] = true
+			forms = append(forms, form)
+		}
+		session.Forms = forms
+		// a valid form with the same ID keeps its state and its monitor
+		for _, record := range quarantined {
+			if !ids[record.Form.ID] {
+				delete(session.FormStates, record.Form.ID)
+				stopped = append(stopped, record.Form.ID)
+			}
+		}
+		cleaned = *session
+
+		if len(quarantined) == 0 {
+			return nil
+		}
+		var records []QuarantinedForm
+		item, err := txn.Get(quarantineKey)
+		if err == nil {
+			err = item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &records)
+			})
+		}
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		records = append(records, quarantined...)
+		jsn, err := json.Marshal(records)
+		if err != nil {
+			return err
+		}
+		return txn.Set(quarantineKey, jsn)
 	})
 	if err != nil {
-		log.Println("Error: could not read session from DB while updating session: ", err)
-		return err
+		log.Println("Error: could not store quarantined forms: ", err)
+		return Session{}, err
 	}
 
-	if update.Step != nil {
-		session.Step = *update.Step
+	for _, formID := range stopped {
+		stopMonitoring(chatID, formID)
 	}
-	if update.Command != nil {
-		session.Command = *update.Command
+	if len(quarantined) > 0 {
+		enqueueMessage(chatID, eventID("quarantine", chatID, quarantined[0].Time), quarantinedFormsString(quarantined), false)
 	}
-	if update.FormsStatus != nil {
-		session.FormsStatus = *update.FormsStatus
+
+	return cleaned, nil
+}
+
+// quarantinedFormsString tells the chat which forms are no longer monitored
+func quarantinedFormsString(quarantined []QuarantinedForm) string {
+	lines := []string{"⚠️ Эти формы повреждены и больше не отслеживаются:"}
+	for _, record := range quarantined {
+		lines = append(lines, fmt.Sprintf("%d. %s → %s", record.Form.ID, record.Form.DeparturePoint, record.Form.ArrivalPoint))
 	}
+	lines = append(lines, "Зарегистрируйте их заново через /start.")
+	return strings.Join(lines, "\n")
+}
 
-	data, err := json.Marshal(session)
+// checks every stored session on startup, so the monitor never sees a broken record
+func quarantineInvalidSessions() error {
+	invalid := []int64{}
+
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			chatID, err := strconv.ParseInt(string(item.Key()), 10, 64)
+			if err != nil {
+				continue // not a session
+			}
+
+			var session Session
+			err = item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &session)
+			})
+			if err != nil {
+				log.Printf("Error: could not unmarshal session of chat %d: %v", chatID, err)
+				continue
+			}
+
+			if err := session.Validate(); err != nil {
+				log.Printf("Error: stored session of chat %d is invalid: %v", chatID, err)
+				invalid = append(invalid, chatID)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		log.Println("Error: could not marshal updated session:", err)
+		log.Println("Error: could not scan sessions: ", err)
 		return err
 	}
 
-	err = db.Update(func(txn *badger.Txn) error {
-		return txn.Set(key, data)
+	for _, chatID := range invalid {
+		if _, err := quarantineInvalidForms(chatID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ---- history ----
+
+// how many states of a form are kept
+const maxHistoryEntries = 50
+
+// key: "history:<chatID>:<formID>", value: []HistoryEntry in json, oldest first
+func getHistoryDBKey(chatID int64, formID int) []byte {
+	return []byte(fmt.Sprintf("history:%d:%d", chatID, formID))
+}
+
+// records a state of the form, dropping the oldest entries beyond maxHistoryEntries
+func appendFormHistory(chatID int64, formID int, state FormState, detected time.Time) error {
+	key := getHistoryDBKey(chatID, formID)
+	entry := HistoryEntry{Time: detected, Price: state.Price, BestPrice: bestPrice(state), ReturnPrice: state.ReturnPrice, ClassPrices: state.ClassPrices}
+
+	err := updateDB(func(txn *badger.Txn) error {
+		var history []HistoryEntry
+		item, err := txn.Get(key)
+		if err == nil {
+			err = item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &history)
+			})
+		}
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		history = append(history, entry)
+		if len(history) > maxHistoryEntries {
+			history = history[len(history)-maxHistoryEntries:]
+		}
+		jsn, err := json.Marshal(history)
+		if err != nil {
+			return err
+		}
+		return txn.Set(key, jsn)
 	})
 	if err != nil {
-		log.Println("Error: updating session in DB: ", err)
+		log.Println("Error: could not store form history: ", err)
 		return err
 	}
 
 	return nil
 }
 
-// ---- forms ----
-
-// inserts empty form in user session. must have a session, or will cause error
-func insertEmptyForm(chatID int64) error {
-	var session Session
-	key := getDBKey(chatID)
+func getFormHistory(chatID int64, formID int) ([]HistoryEntry, error) {
+	var history []HistoryEntry
+	key := getHistoryDBKey(chatID, formID)
 
 	err := db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get(key)
 		if err != nil {
-			if err == badger.ErrKeyNotFound {
-				log.Println("Error(db): user does not have a session while crearting empty form: ", err)
-			}
-
-			log.Println("Error(db): could not get item by key while crearting empty form: ", err)
 			return err
 		}
-
 		return item.Value(func(val []byte) error {
-			return json.Unmarshal(val, &session)
+			return json.Unmarshal(val, &history)
 		})
 	})
-	if err != nil && err != badger.ErrKeyNotFound {
-		log.Println("Error: could not view user database: ", err)
-		return err
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		log.Println("Error: could not read form history: ", err)
+		return nil, err
 	}
 
-	session.Forms = append(session.Forms, Form{ID: len(session.Forms)})
+	return history, nil
+}
 
-	jsn, err := json.Marshal(session)
+// lowest price recorded in the form history, the price of older entries without BestPrice counts instead
+func lowestHistoryPrice(chatID int64, formID int) (Price, error) {
+	history, err := getFormHistory(chatID, formID)
 	if err != nil {
-		log.Println("Error: could not unmarshall session with empty form: ", err)
-		return err
+		return priceUnknown, err
 	}
 
-	err = db.Update(func(txn *badger.Txn) error {
+	lowest := priceUnknown
+	for _, entry := range history {
+		price := entry.BestPrice
+		if price.Availability == "" {
+			price = entry.Price
+		}
+		if price.Less(lowest) {
+			lowest = price
+		}
+	}
+	return lowest, nil
+}
+
+// ---- pending notifications ----
+
+const pendingKeyPrefix = "pending:"
+
+// key: "pending:<chatID>", value: PendingNotifications in json
+func getPendingDBKey(chatID int64) []byte {
+	return []byte(fmt.Sprintf("%s%d", pendingKeyPrefix, chatID))
+}
+
+// holds back a notification until the quiet hours end, or for the next digest
+func appendPendingNotification(chatID int64, notification PendingNotification, held bool) error {
+	return updatePendingNotifications(chatID, func(pending *PendingNotifications) {
+		if held {
+			pending.Held = append(pending.Held, notification)
+		} else {
+			pending.Digest = append(pending.Digest, notification)
+		}
+	})
+}
+
+// reads, changes and stores the pending notifications of the chat in one transaction
+func updatePendingNotifications(chatID int64, update func(pending *PendingNotifications)) error {
+	key := getPendingDBKey(chatID)
+
+	err := updateDB(func(txn *badger.Txn) error {
+		var pending PendingNotifications
+		item, err := txn.Get(key)
+		if err == nil {
+			err = item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &pending)
+			})
+		}
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		update(&pending)
+
+		jsn, err := json.Marshal(pending)
+		if err != nil {
+			return err
+		}
 		return txn.Set(key, jsn)
 	})
 	if err != nil {
-		log.Println("Error: updating db while creating empty form: ", err)
+		log.Println("Error: could not update pending notifications: ", err)
 		return err
 	}
 
 	return nil
 }
 
-func updateLastForm(chatID int64, update FormUpdate) error {
-	var session Session
-	key := getDBKey(chatID)
+// chats that have pending notification records
+func getPendingChats() ([]int64, error) {
+	chatIDs := []int64{}
 
 	err := db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(key)
-		if err != nil {
-			return err
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte(pendingKeyPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			chatID, err := strconv.ParseInt(strings.TrimPrefix(string(it.Item().Key()), pendingKeyPrefix), 10, 64)
+			if err != nil {
+				continue
+			}
+			chatIDs = append(chatIDs, chatID)
 		}
-		return item.Value(func(val []byte) error {
-			return json.Unmarshal(val, &session)
-		})
+		return nil
 	})
 	if err != nil {
-		log.Println("Error: could not get current session: ", err)
-		return err
+		log.Println("Error: could not scan pending notifications: ", err)
+		return nil, err
 	}
 
-	if len(session.Forms) == 0 {
-		log.Println("Error: no forms in session.")
-		return fmt.Errorf("no forms in session")
+	return chatIDs, nil
+}
+
+// lists the chats with a session
+func getSessionChats() ([]int64, error) {
+	chatIDs := []int64{}
+
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			chatID, err := strconv.ParseInt(string(it.Item().Key()), 10, 64)
+			if err != nil {
+				continue // not a session
+			}
+			chatIDs = append(chatIDs, chatID)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Error: could not scan sessions: ", err)
+		return nil, err
 	}
 
-	form := &session.Forms[len(session.Forms)-1]
+	return chatIDs, nil
+}
+
+// ---- outbox ----
+
+const (
+	outboxKeyPrefix = "outbox:"
+	eventTTL        = 24 * time.Hour // how long a sent event is remembered for deduplication
+)
+
+// key: "outbox:<created unix nanos>:<eventID>", value: OutboxMessage in json. keys sort in the order of enqueueing
+func getOutboxDBKey(message OutboxMessage) []byte {
+	return []byte(fmt.Sprintf("%s%020d:%s", outboxKeyPrefix, message.Created.UnixNano(), message.EventID))
+}
+
+// key: "event:<eventID>", no value, expires after eventTTL
+func getEventDBKey(eventID string) []byte {
+	return []byte("event:" + eventID)
+}
+
+// stores the message in the outbox unless its event was already enqueued. reports if it was stored
+func enqueueOutboxMessage(message OutboxMessage) (bool, error) {
+	eventKey := getEventDBKey(message.EventID)
+	stored := false
+
+	err := db.Update(func(txn *badger.Txn) error {
+		_, err := txn.Get(eventKey)
+		if err == nil {
+			return nil // duplicate event
+		}
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
 
-	if update.DeparturePoint != nil {
-		form.DeparturePoint = *update.DeparturePoint
+		jsn, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		if err := txn.SetEntry(badger.NewEntry(eventKey, nil).WithTTL(eventTTL)); err != nil {
+			return err
+		}
+		stored = true
+		return txn.Set(getOutboxDBKey(message), jsn)
+	})
+	if err != nil {
+		log.Println("Error: could not enqueue outbox message: ", err)
+		return false, err
 	}
-	if update.ArrivalPoint != nil {
-		form.ArrivalPoint = *update.ArrivalPoint
+
+	return stored, nil
+}
+
+// finds the oldest outbox message due at now. ok is false if there is none
+func nextOutboxMessage(now time.Time) (key []byte, message OutboxMessage, ok bool, err error) {
+	err = db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(outboxKeyPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var m OutboxMessage
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &m)
+			})
+			if err != nil {
+				log.Printf("Error: could not unmarshal outbox message %s: %v", it.Item().Key(), err)
+				continue
+			}
+			if m.NotBefore.After(now) {
+				continue
+			}
+			key, message, ok = it.Item().KeyCopy(nil), m, true
+			return nil
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Error: could not scan outbox: ", err)
 	}
-	if update.DepartureDate != nil {
-		form.DepartureDate = *update.DepartureDate
+	return key, message, ok, err
+}
+
+func updateOutboxMessage(key []byte, message OutboxMessage) error {
+	jsn, err := json.Marshal(message)
+	if err != nil {
+		log.Println("Error: could not marshal outbox message: ", err)
+		return err
 	}
-	if update.CarriageType != nil {
-		form.CarriageType = *update.CarriageType
+
+	err = db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, jsn)
+	})
+	if err != nil {
+		log.Println("Error: could not update outbox message: ", err)
+		return err
 	}
-	if update.NumberOfPassengers != nil {
-		form.NumberOfPassengers = *update.NumberOfPassengers
+
+	return nil
+}
+
+func deleteOutboxMessage(key []byte) error {
+	err := db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+	if err != nil {
+		log.Println("Error: could not delete outbox message: ", err)
+		return err
 	}
-	if update.CompartmentNumber != nil {
-		form.CompartmentNumber = *update.CompartmentNumber
+
+	return nil
+}
+
+// removes every outbox message of the chat, returns how many were dropped
+func dropChatOutbox(chatID int64) (int, error) {
+	var keys [][]byte
+
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(outboxKeyPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var m OutboxMessage
+			err := it.Item().Value(func(val []byte) error {
+				return json.Unmarshal(val, &m)
+			})
+			if err == nil && m.ChatID == chatID {
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Error: could not scan outbox: ", err)
+		return 0, err
 	}
-	if update.ShelfType != nil {
-		form.ShelfType = *update.ShelfType
+
+	err = db.Update(func(txn *badger.Txn) error {
+		for _, key := range keys {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Error: could not drop outbox messages: ", err)
+		return 0, err
 	}
-	if update.NumberOfPassengersTopShefl != nil {
-		form.NumberOfPassengersTopShefl = *update.NumberOfPassengersTopShefl
+
+	return len(keys), nil
+}
+
+// ---- archive ----
+
+// key: "archive:<chatID>", value: []ArchivedForm in json
+// how many archived forms are kept, the oldest go first
+const maxArchivedForms = 50
+
+func getArchiveDBKey(chatID int64) []byte {
+	return []byte(fmt.Sprintf("archive:%d", chatID))
+}
+
+// moves the form with formID out of the session into the archive record
+func archiveForm(chatID int64, formID int, lowest Price) error {
+	archiveKey := getArchiveDBKey(chatID)
+
+	err := changeSession(chatID, func(txn *badger.Txn, session *Session) error {
+		var archived []ArchivedForm
+		forms := []Form{}
+		for _, form := range session.Forms {
+			if form.ID == formID {
+				archived = append(archived, ArchivedForm{Form: form, LowestPrice: lowest, Time: time.Now()})
+				continue
+			}
+			forms = append(forms, form)
+		}
+		if len(archived) == 0 {
+			return fmt.Errorf("no form %d in session", formID)
+		}
+		session.Forms = forms
+		delete(session.FormStates, formID)
+
+		var records []ArchivedForm
+		item, err := txn.Get(archiveKey)
+		if err == nil {
+			err = item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &records)
+			})
+		}
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		records = append(records, archived...)
+		if len(records) > maxArchivedForms {
+			records = records[len(records)-maxArchivedForms:]
+		}
+		jsn, err := json.Marshal(records)
+		if err != nil {
+			return err
+		}
+		return txn.Set(archiveKey, jsn)
+	})
+	if err != nil {
+		log.Println("Error: could not archive form: ", err)
+		return err
 	}
-	if update.NumberOfPassengersBottomShefl != nil {
-		form.NumberOfPassengersBottomShefl = *update.NumberOfPassengersBottomShefl
+
+	return nil
+}
+
+func getArchivedForms(chatID int64) ([]ArchivedForm, error) {
+	var records []ArchivedForm
+	key := getArchiveDBKey(chatID)
+
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &records)
+		})
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
 	}
-	if update.TrackPriceChange != nil {
-		form.TrackPriceChange = *update.TrackPriceChange
+	if err != nil {
+		log.Println("Error: could not read archived forms: ", err)
+		return nil, err
 	}
-	if update.SuggestSimilarSeats != nil {
-		form.SuggestSimilarSeats = *update.SuggestSimilarSeats
+
+	return records, nil
+}
+
+// ---- forms ----
+
+// next free form ID in the session. IDs are never reused, so the history, archive and events of a removed form
+// never attach to a new one
+func nextFormID(session Session) int {
+	id := session.NextFormID
+	for _, form := range session.Forms {
+		if form.ID >= id {
+			id = form.ID + 1
+		}
 	}
+	return id
+}
 
-	jsn, err := json.Marshal(session)
+// inserts empty form in user session. must have a session, or will cause error
+func insertEmptyForm(chatID int64) error {
+	_, err := insertForm(chatID, Form{})
+	return err
+}
+
+// appends form to user session with a fresh ID and returns it. must have a session, or will cause error
+func insertForm(chatID int64, form Form) (int, error) {
+	err := changeSession(chatID, func(txn *badger.Txn, session *Session) error {
+		form.ID = nextFormID(*session)
+		session.NextFormID = form.ID + 1
+		session.Forms = append(session.Forms, form)
+		return nil
+	})
+	if err == badger.ErrKeyNotFound {
+		log.Println("Error(db): user does not have a session while inserting form: ", err)
+	}
 	if err != nil {
-		log.Println("Error: failed to marshal updated session: ", err)
-		return err
+		log.Println("Error: updating db while inserting form: ", err)
+		return 0, err
 	}
 
-	err = db.Update(func(txn *badger.Txn) error {
-		return txn.Set(key, jsn)
+	return form.ID, nil
+}
+
+func updateLastForm(chatID int64, update FormUpdate) error {
+	err := changeSession(chatID, func(txn *badger.Txn, session *Session) error {
+		if len(session.Forms) == 0 {
+			return fmt.Errorf("no forms in session")
+		}
+
+		form := &session.Forms[len(session.Forms)-1]
+
+		if update.DeparturePoint != nil {
+			form.DeparturePoint = *update.DeparturePoint
+		}
+		if update.ArrivalPoint != nil {
+			form.ArrivalPoint = *update.ArrivalPoint
+		}
+		if update.DepartureDate != nil {
+			form.DepartureDate = *update.DepartureDate
+		}
+		if update.DepartureDateTo != nil {
+			form.DepartureDateTo = *update.DepartureDateTo
+		}
+		if update.RoundTrip != nil {
+			form.RoundTrip = *update.RoundTrip
+		}
+		if update.ReturnDate != nil {
+			form.ReturnDate = *update.ReturnDate
+		}
+		if update.RoundTripBudget != nil {
+			form.RoundTripBudget = *update.RoundTripBudget
+		}
+		if update.CarriageType != nil {
+			form.CarriageType = *update.CarriageType
+		}
+		if update.NumberOfPassengers != nil {
+			form.NumberOfPassengers = *update.NumberOfPassengers
+		}
+		if update.CompartmentNumber != nil {
+			form.CompartmentNumber = *update.CompartmentNumber
+		}
+		if update.NoSideShefl != nil {
+			form.NoSideShefl = *update.NoSideShefl
+		}
+		if update.ShelfType != nil {
+			form.ShelfType = *update.ShelfType
+		}
+		if update.NumberOfPassengersTopShefl != nil {
+			form.NumberOfPassengersTopShefl = *update.NumberOfPassengersTopShefl
+		}
+		if update.NumberOfPassengersBottomShefl != nil {
+			form.NumberOfPassengersBottomShefl = *update.NumberOfPassengersBottomShefl
+		}
+		if update.NumberOfPassengersSideShefl != nil {
+			form.NumberOfPassengersSideShefl = *update.NumberOfPassengersSideShefl
+		}
+		if update.DepartureWindow != nil {
+			form.DepartureWindow = *update.DepartureWindow
+		}
+		if update.ArrivalWindow != nil {
+			form.ArrivalWindow = *update.ArrivalWindow
+		}
+		if update.MaxTripDuration != nil {
+			form.MaxTripDuration = *update.MaxTripDuration
+		}
+		if update.TrainNumbers != nil {
+			form.TrainNumbers = *update.TrainNumbers
+		}
+		if update.TrackPriceChange != nil {
+			form.TrackPriceChange = *update.TrackPriceChange
+		}
+		if update.ChangeThreshold != nil {
+			form.ChangeThreshold = *update.ChangeThreshold
+		}
+		if update.ChangeThresholdPercent != nil {
+			form.ChangeThresholdPercent = *update.ChangeThresholdPercent
+		}
+		if update.ChangeDirection != nil {
+			form.ChangeDirection = *update.ChangeDirection
+		}
+		if update.PriceCeiling != nil {
+			form.PriceCeiling = *update.PriceCeiling
+		}
+		if update.PriceCeilingPerPassenger != nil {
+			form.PriceCeilingPerPassenger = *update.PriceCeilingPerPassenger
+		}
+		if update.SuggestSimilarSeats != nil {
+			form.SuggestSimilarSeats = *update.SuggestSimilarSeats
+		}
+		return nil
 	})
 	if err != nil {
-		log.Println("Error: failed to update session in db: ", err)
+		log.Println("Error: failed to update last form in db: ", err)
 		return err
 	}
 
@@ -270,3 +1056,180 @@ func getLastForm(chatID int64) (Form, error) {
 
 	return session.Forms[len(session.Forms)-1], nil
 }
+
+// marks the form with formID paused or resumed
+func setFormPaused(chatID int64, formID int, paused bool) error {
+	err := changeSession(chatID, func(txn *badger.Txn, session *Session) error {
+		for i := range session.Forms {
+			if session.Forms[i].ID == formID {
+				session.Forms[i].Paused = paused
+				return nil
+			}
+		}
+		return fmt.Errorf("no form %d in session", formID)
+	})
+	if err != nil {
+		log.Println("Error: failed to pause form in db: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// removes the form with formID from user session, with its history
+func removeForm(chatID int64, formID int) error {
+	err := changeSession(chatID, func(txn *badger.Txn, session *Session) error {
+		forms := []Form{}
+		for _, form := range session.Forms {
+			if form.ID != formID {
+				forms = append(forms, form)
+			}
+		}
+		if len(forms) == len(session.Forms) {
+			return fmt.Errorf("no form %d in session", formID)
+		}
+		session.Forms = forms
+		delete(session.FormStates, formID)
+
+		return txn.Delete(getHistoryDBKey(chatID, formID))
+	})
+	if err != nil {
+		log.Println("Error: failed to remove form in db: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// puts the last (current) form in place of the form with formID, keeping formID. returns the stored form
+func replaceFormWithLast(chatID int64, formID int) (Form, error) {
+	var last Form
+	err := changeSession(chatID, func(txn *badger.Txn, session *Session) error {
+		if len(session.Forms) == 0 {
+			return fmt.Errorf("no forms in session")
+		}
+		last = session.Forms[len(session.Forms)-1]
+		session.Forms = session.Forms[:len(session.Forms)-1]
+
+		for i := range session.Forms {
+			if session.Forms[i].ID == formID {
+				last.ID = formID
+				session.Forms[i] = last
+				return nil
+			}
+		}
+		return fmt.Errorf("no form %d in session", formID)
+	})
+	if err != nil {
+		log.Println("Error: failed to replace form in db: ", err)
+		return Form{}, err
+	}
+
+	return last, nil
+}
+
+// clears Inactive on the forms of the chat, returns the forms it cleared. a chat without inactive forms is not written
+func reactivateForms(chatID int64) ([]Form, error) {
+	var forms []Form
+	err := changeSession(chatID, func(txn *badger.Txn, session *Session) error {
+		forms = []Form{}
+		for i := range session.Forms {
+			if session.Forms[i].Inactive {
+				session.Forms[i].Inactive = false
+				forms = append(forms, session.Forms[i])
+			}
+		}
+		if len(forms) == 0 {
+			return errNothingToChange
+		}
+		return nil
+	})
+	if err == badger.ErrKeyNotFound || err == errNothingToChange {
+		return nil, nil
+	}
+	if err != nil {
+		log.Println("Error: failed to reactivate forms in db: ", err)
+		return nil, err
+	}
+
+	return forms, nil
+}
+
+// marks every form of the chat inactive, returns their IDs
+func deactivateForms(chatID int64) ([]int, error) {
+	var ids []int
+	err := changeSession(chatID, func(txn *badger.Txn, session *Session) error {
+		ids = []int{}
+		for i := range session.Forms {
+			session.Forms[i].Inactive = true
+			ids = append(ids, session.Forms[i].ID)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Error: failed to deactivate forms in db: ", err)
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func getFormByID(chatID int64, formID int) (Form, error) {
+	var session Session
+	key := getDBKey(chatID)
+
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &session)
+		})
+	})
+	if err != nil {
+		log.Println("Error: could not read session from DB while getting form: ", err)
+		return Form{}, err
+	}
+
+	for _, form := range session.Forms {
+		if form.ID == formID {
+			return form, nil
+		}
+	}
+	return Form{}, fmt.Errorf("no form %d in session", formID)
+}
+
+// records the state of the form when its monitor started
+func setFormState(chatID int64, formID int, state FormState) error {
+	err := changeSession(chatID, func(txn *badger.Txn, session *Session) error {
+		if session.FormStates == nil {
+			session.FormStates = map[int]FormState{}
+		}
+		session.FormStates[formID] = state
+		return nil
+	})
+	if err != nil {
+		log.Println("Error: failed to set form state in db: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// removes the last (current) form from user session
+func removeLastForm(chatID int64) error {
+	err := changeSession(chatID, func(txn *badger.Txn, session *Session) error {
+		if len(session.Forms) == 0 {
+			return fmt.Errorf("no forms in session")
+		}
+		session.Forms = session.Forms[:len(session.Forms)-1]
+		return nil
+	})
+	if err != nil {
+		log.Println("Error: failed to remove last form in db: ", err)
+		return err
+	}
+
+	return nil
+}
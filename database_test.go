@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// openTestDB puts an in-memory database in place of db for the test
+func openTestDB(t *testing.T) {
+	t.Helper()
+	testDB, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := db
+	db = testDB
+	t.Cleanup(func() {
+		db = saved
+		testDB.Close()
+	})
+}
+
+func TestMigrateLegacyCompartments(t *testing.T) {
+	tests := []struct {
+		name             string
+		form             Form
+		wantCompartments []int
+		wantNoSide       bool
+	}{
+		{"not side", Form{CarriageType: "Плацкарт", CompartmentNumber: []int{2, 3, 4, 5, 6, 8}}, allCompartments(CarriagePlackart), true},
+		{"not side in kupe", Form{CarriageType: CarriageKupe, CompartmentNumber: []int{2, 3, 4, 5, 6, 8}}, allCompartments(CarriageKupe), false},
+		{"any", Form{CarriageType: CarriagePlackart, CompartmentNumber: []int{1, 2, 3, 4, 5, 6, 8, 9}}, allCompartments(CarriagePlackart), false},
+		{"custom", Form{CarriageType: CarriagePlackart, CompartmentNumber: []int{2, 3}}, []int{2, 3}, false},
+	}
+	for _, tt := range tests {
+		form := tt.form
+		migrateForm(&form)
+		if !slices.Equal(form.CompartmentNumber, tt.wantCompartments) || form.NoSideShefl != tt.wantNoSide {
+			t.Errorf("%s: migrated to %v, NoSideShefl %v, want %v, %v", tt.name, form.CompartmentNumber, form.NoSideShefl, tt.wantCompartments, tt.wantNoSide)
+		}
+	}
+}
+
+func TestNextFormID(t *testing.T) {
+	tests := []struct {
+		name    string
+		session Session
+		want    int
+	}{
+		{"empty", Session{}, 0},
+		{"legacy session", Session{Forms: []Form{{ID: 0}, {ID: 3}}}, 4},
+		{"removed forms are not reused", Session{NextFormID: 7, Forms: []Form{{ID: 2}}}, 7},
+		{"all forms removed", Session{NextFormID: 5}, 5},
+	}
+	for _, tt := range tests {
+		if got := nextFormID(tt.session); got != tt.want {
+			t.Errorf("%s: nextFormID = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConcurrentSessionWrites(t *testing.T) {
+	openTestDB(t)
+	const chatID = 1
+	if err := createSession(chatID); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateSession(chatID, SessionUpdate{Command: strPtr("start")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := insertEmptyForm(chatID); err != nil {
+		t.Fatal(err)
+	}
+
+	// every writer reads the whole session, none of them may lose what another one wrote meanwhile
+	const writers = 20
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := setFormState(chatID, 100+i, FormState{Price: rublePrice(i)}); err != nil {
+				t.Error(err)
+			}
+			if err := updateSession(chatID, SessionUpdate{Step: intPtr(i)}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	session, err := getSession(chatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(session.FormStates) != writers {
+		t.Errorf("%d form states stored, want %d", len(session.FormStates), writers)
+	}
+	if len(session.Forms) != 1 {
+		t.Errorf("%d forms stored, want 1", len(session.Forms))
+	}
+}
+
+// useTestCities puts a few known cities in place of the loaded ones for the test
+func useTestCities(t *testing.T) {
+	t.Helper()
+	saved := cities
+	cities = map[string]string{"Москва": "2000000", "Санкт-Петербург": "2004000", "Казань": "2060500", "Нижний Новгород": "2060001", "Нижнекамск": "2060560"}
+	t.Cleanup(func() { cities = saved })
+}
+
+// testForm is a complete valid form
+func testForm(id int) Form {
+	return Form{
+		ID:                 id,
+		DeparturePoint:     "Москва",
+		ArrivalPoint:       "Казань",
+		DepartureDate:      time.Date(2026, 11, 20, 0, 0, 0, 0, time.UTC),
+		CarriageType:       CarriageKupe,
+		NumberOfPassengers: 2,
+		CompartmentNumber:  allCompartments(CarriageKupe),
+		ShelfType:          ShelfAny,
+	}
+}
+
+func TestFormValidate(t *testing.T) {
+	useTestCities(t)
+
+	tests := []struct {
+		name   string
+		change func(form *Form)
+		field  string // the field with the error, none if valid
+	}{
+		{"valid", func(form *Form) {}, ""},
+		{"unknown city", func(form *Form) { form.ArrivalPoint = "Атлантида" }, "ArrivalPoint"},
+		{"same points", func(form *Form) { form.ArrivalPoint = form.DeparturePoint }, "ArrivalPoint"},
+		{"no date", func(form *Form) { form.DepartureDate = time.Time{} }, "DepartureDate"},
+		{"two weeks range", func(form *Form) { form.DepartureDateTo = form.DepartureDate.AddDate(0, 0, 13) }, ""},
+		{"longer range", func(form *Form) { form.DepartureDateTo = form.DepartureDate.AddDate(0, 0, 14) }, "DepartureDateTo"},
+		{"range backwards", func(form *Form) { form.DepartureDateTo = form.DepartureDate.AddDate(0, 0, -1) }, "DepartureDateTo"},
+		{"return before departure", func(form *Form) {
+			form.RoundTrip, form.ReturnDate = true, form.DepartureDate.AddDate(0, 0, -1)
+		}, "ReturnDate"},
+		{"too many passengers", func(form *Form) { form.NumberOfPassengers = 7 }, "NumberOfPassengers"},
+		{"unknown carriage", func(form *Form) { form.CarriageType = "Плацкарт" }, "CarriageType"},
+		{"compartment out of the carriage", func(form *Form) { form.CompartmentNumber = []int{10} }, "CompartmentNumber"},
+		{"no compartments", func(form *Form) { form.CompartmentNumber = nil }, "CompartmentNumber"},
+		{"shelves do not add up", func(form *Form) {
+			form.ShelfType, form.NumberOfPassengersBottomShefl = ShelfBottom, 1
+		}, "ShelfType"},
+		{"side shelves in kupe", func(form *Form) {
+			form.ShelfType, form.NumberOfPassengersBottomShefl, form.NumberOfPassengersSideShefl = ShelfBottom, 1, 1
+		}, "NumberOfPassengersSideShefl"},
+		{"empty time window", func(form *Form) { form.DepartureWindow = TimeWindow{From: 60, To: 60} }, "DepartureWindow"},
+		{"time window past midnight", func(form *Form) { form.ArrivalWindow = TimeWindow{From: 60, To: 24 * 60} }, "ArrivalWindow"},
+		{"negative ceiling", func(form *Form) { form.PriceCeiling = -1 }, "PriceCeiling"},
+		{"empty train number", func(form *Form) { form.TrainNumbers = []string{"020У", " "} }, "TrainNumbers"},
+	}
+	for _, tt := range tests {
+		form := testForm(1)
+		tt.change(&form)
+		err := form.Validate()
+		if tt.field == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		errs, ok := err.(ValidationError)
+		if !ok || !slices.ContainsFunc(errs, func(e FieldError) bool { return e.Field == tt.field }) {
+			t.Errorf("%s: got %v, want an error in %s", tt.name, err, tt.field)
+		}
+	}
+
+	// the wizard stores the form field by field, only the fields set so far are checked
+	if err := (Form{DeparturePoint: "Москва"}).validate(false); err != nil {
+		t.Errorf("incomplete form: %v", err)
+	}
+	if err := (Form{NumberOfPassengers: 9}).validate(false); err == nil {
+		t.Errorf("incomplete form with a wrong field is valid")
+	}
+}
+
+func TestSessionValidate(t *testing.T) {
+	useTestCities(t)
+
+	tests := []struct {
+		name    string
+		session Session
+		valid   bool
+	}{
+		{"valid", Session{Command: "none", Forms: []Form{testForm(1), testForm(2)}}, true},
+		{"wizard fills the last form", Session{Command: "start", Forms: []Form{testForm(1), {ID: 2, DeparturePoint: "Москва"}}}, true},
+		{"incomplete form outside the wizard", Session{Command: "none", Forms: []Form{testForm(1), {ID: 2, DeparturePoint: "Москва"}}}, false},
+		{"incomplete form before the last", Session{Command: "start", Forms: []Form{{ID: 1}, testForm(2)}}, false},
+		{"unknown command", Session{Command: "stop"}, false},
+		{"negative step", Session{Command: "none", Step: -1}, false},
+		{"unknown timezone", Session{Command: "none", Timezone: "Mars/Base"}, false},
+		{"known timezone", Session{Command: "none", Timezone: "UTC"}, true},
+		{"duplicate form IDs", Session{Command: "none", Forms: []Form{testForm(1), testForm(1)}}, false},
+		{"digest without interval", Session{Command: "none", DigestMode: DigestInterval}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.session.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%s: Validate() = %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestQuarantineOnLoad(t *testing.T) {
+	openTestDB(t)
+	useTestCities(t)
+	const chatID = 2
+
+	broken := testForm(2)
+	broken.NumberOfPassengers = 9
+	stored := Session{
+		Command:    "none",
+		Timezone:   "Mars/Base",
+		NextFormID: 3,
+		Forms:      []Form{testForm(1), broken},
+		FormStates: map[int]FormState{1: {Price: rublePrice(1000)}, 2: {Price: rublePrice(2000)}},
+	}
+	jsn, err := json.Marshal(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		return txn.Set(getDBKey(chatID), jsn)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both forms have a running monitor
+	stoppedForms := map[int]bool{}
+	for _, formID := range []int{1, 2} {
+		monitoringMutex.Lock()
+		monitoringCancelFuncs[monitoringKey{chatID, formID}] = func() { stoppedForms[formID] = true }
+		monitoringMutex.Unlock()
+	}
+	t.Cleanup(func() {
+		monitoringMutex.Lock()
+		delete(monitoringCancelFuncs, monitoringKey{chatID, 1})
+		monitoringMutex.Unlock()
+	})
+
+	session, err := getSession(chatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(session.Forms) != 1 || session.Forms[0].ID != 1 {
+		t.Errorf("forms left: %+v", session.Forms)
+	}
+	if session.Timezone != "" {
+		t.Errorf("timezone %q kept", session.Timezone)
+	}
+	if _, ok := session.FormStates[2]; ok || len(session.FormStates) != 1 {
+		t.Errorf("form states left: %v", session.FormStates)
+	}
+	if !stoppedForms[2] || stoppedForms[1] {
+		t.Errorf("stopped monitors: %v, want only form 2", stoppedForms)
+	}
+
+	var records []QuarantinedForm
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(getQuarantineDBKey(chatID))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &records)
+		})
+	})
+	if err != nil || len(records) != 1 || records[0].Form.ID != 2 {
+		t.Errorf("quarantine record: %+v, %v", records, err)
+	}
+
+	// the cleaned session is stored, so it can be written again
+	if err := updateSession(chatID, SessionUpdate{Step: intPtr(1)}); err != nil {
+		t.Errorf("updateSession after quarantine: %v", err)
+	}
+}
+
+func TestArchiveKeepsNewestForms(t *testing.T) {
+	openTestDB(t)
+	useTestCities(t)
+	const chatID = 3
+	if err := createSession(chatID); err != nil {
+		t.Fatal(err)
+	}
+
+	for range maxArchivedForms + 5 {
+		formID, err := insertForm(chatID, testForm(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := archiveForm(chatID, formID, rublePrice(1000)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := getArchivedForms(chatID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != maxArchivedForms || records[0].Form.ID != 5 || records[len(records)-1].Form.ID != maxArchivedForms+4 {
+		t.Errorf("archive has %d forms from %d to %d, want %d from 5", len(records), records[0].Form.ID, records[len(records)-1].Form.ID, maxArchivedForms)
+	}
+}
+
+func TestEnumLabels(t *testing.T) {
+	check := func(kind string, values []string, labels []string, legacy map[string]string) {
+		seen := map[string]string{}
+		for i, value := range values {
+			label := labels[i]
+			if _, ok := seen[label]; label == "" || ok {
+				t.Errorf("%s %q: label %q empty or repeated", kind, value, label)
+			}
+			seen[label] = value
+		}
+		// a label stored before the enums migrates to the value still shown with it
+		for label, value := range legacy {
+			if seen[label] != value {
+				t.Errorf("%s: legacy label %q migrates to %q, shown for %q", kind, label, value, seen[label])
+			}
+		}
+	}
+
+	values, labels, legacy := []string{}, []string{}, map[string]string{}
+	for _, c := range carriageTypes {
+		values, labels = append(values, string(c)), append(labels, c.Label())
+	}
+	for label, c := range legacyCarriageTypes {
+		legacy[label] = string(c)
+	}
+	check("carriage type", values, labels, legacy)
+
+	values, labels, legacy = []string{}, []string{}, map[string]string{}
+	for _, s := range shelfTypes {
+		values, labels = append(values, string(s)), append(labels, s.Label())
+	}
+	for label, s := range legacyShelfTypes {
+		legacy[label] = string(s)
+	}
+	check("shelf type", values, labels, legacy)
+
+	values, labels = []string{}, []string{}
+	for _, c := range compartmentPresets {
+		values, labels = append(values, string(c)), append(labels, c.Label())
+	}
+	check("compartment preset", values, labels, nil)
+}
+
+func TestMigrateLegacyEnums(t *testing.T) {
+	tests := []struct {
+		name         string
+		form         Form
+		wantCarriage CarriageType
+		wantShelf    ShelfType
+		wantMigrated bool
+	}{
+		{"labels", Form{CarriageType: "Купе", ShelfType: "Указать верхние", CompartmentNumber: allCompartments(CarriageKupe)}, CarriageKupe, ShelfTop, true},
+		{"carriage label only", Form{CarriageType: "Любой", ShelfType: ShelfAny, CompartmentNumber: allCompartments(CarriageAny)}, CarriageAny, ShelfAny, true},
+		{"values", Form{CarriageType: CarriagePlackart, ShelfType: ShelfBottom, CompartmentNumber: allCompartments(CarriagePlackart)}, CarriagePlackart, ShelfBottom, false},
+	}
+	for _, tt := range tests {
+		form := tt.form
+		migrated := migrateForm(&form)
+		if form.CarriageType != tt.wantCarriage || form.ShelfType != tt.wantShelf || migrated != tt.wantMigrated {
+			t.Errorf("%s: migrated to %q, %q (%v), want %q, %q (%v)", tt.name, form.CarriageType, form.ShelfType, migrated, tt.wantCarriage, tt.wantShelf, tt.wantMigrated)
+		}
+	}
+}
+
+func TestMigrateSessions(t *testing.T) {
+	openTestDB(t)
+	const chatID = 4
+
+	legacy := testForm(0)
+	legacy.CarriageType, legacy.ShelfType = "Плацкарт", "Указать нижние"
+	legacy.CompartmentNumber = allCompartments(CarriagePlackart)
+	jsn, err := json.Marshal(Session{Command: "none", NextFormID: 1, Forms: []Form{legacy}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		return txn.Set(getDBKey(chatID), jsn)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := migrateSessions(); err != nil {
+		t.Fatal(err)
+	}
+
+	var session Session
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(getDBKey(chatID))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &session)
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form := session.Forms[0]; form.CarriageType != CarriagePlackart || form.ShelfType != ShelfBottom {
+		t.Errorf("stored form has %q, %q after the migration", form.CarriageType, form.ShelfType)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// used when the user has not set a timezone, trains are scheduled in Moscow time
+const defaultTimezone = "Europe/Moscow"
+
+var weekdayNames = map[string]time.Weekday{
+	"пн": time.Monday, "понедельник": time.Monday,
+	"вт": time.Tuesday, "вторник": time.Tuesday,
+	"ср": time.Wednesday, "среда": time.Wednesday, "среду": time.Wednesday,
+	"чт": time.Thursday, "четверг": time.Thursday,
+	"пт": time.Friday, "пятница": time.Friday, "пятницу": time.Friday,
+	"сб": time.Saturday, "суббота": time.Saturday, "субботу": time.Saturday,
+	"вс": time.Sunday, "воскресенье": time.Sunday,
+}
+
+var monthNames = map[string]time.Month{
+	"января": time.January, "февраля": time.February, "марта": time.March, "апреля": time.April,
+	"мая": time.May, "июня": time.June, "июля": time.July, "августа": time.August,
+	"сентября": time.September, "октября": time.October, "ноября": time.November, "декабря": time.December,
+}
+
+var weekdayShortNames = []string{"вс", "пн", "вт", "ср", "чт", "пт", "сб"}
+
+var (
+	numericDateRe  = regexp.MustCompile(`^(\d{1,2})[./](\d{1,2})(?:[./](\d{2}|\d{4}))?$`)
+	textualDateRe  = regexp.MustCompile(`^(\d{1,2})\s+(\pL+)(?:\s+(\d{4}))?$`)
+	relativeDateRe = regexp.MustCompile(`^через\s+(?:(\d+)\s+)?(\pL+)$`)
+)
+
+var utcOffsetRe = regexp.MustCompile(`^(?:utc|gmt)?([+-])(\d{1,2})$`)
+
+// parseTimezone accepts an IANA name like "Asia/Yekaterinburg" or a whole-hour UTC offset like "+5" or "UTC+5"
+func parseTimezone(s string) (string, bool) {
+	if m := utcOffsetRe.FindStringSubmatch(strings.ToLower(s)); m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		if hours > 14 {
+			return "", false
+		}
+		if hours == 0 {
+			return "UTC", true
+		}
+		// the Etc zones have the sign inverted: UTC+5 is Etc/GMT-5
+		sign := "-"
+		if m[1] == "-" {
+			sign = "+"
+		}
+		return fmt.Sprintf("Etc/GMT%s%d", sign, hours), true
+	}
+	if s == "" || s == "Local" {
+		return "", false
+	}
+	if _, err := time.LoadLocation(s); err != nil {
+		return "", false
+	}
+	return s, true
+}
+
+// sessionLocation returns the timezone the user's dates are interpreted in
+func sessionLocation(session Session) *time.Location {
+	name := session.Timezone
+	if name == "" {
+		name = defaultTimezone
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// calendarDay is the day of t at UTC midnight, the way forms store dates. the datepicker returns local midnight and
+// typed dates are days of the user's timezone, so every date is normalized before it goes into a form
+func calendarDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// pickerDay is the day of a form date at local midnight, the datepicker compares its From and To bounds in time.Local
+func pickerDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+}
+
+// parseNaturalDate parses a typed date like "20.11", "20 ноября", "завтра", "в пятницу" or "через неделю".
+// now must be in the user's timezone, "today" is its day there. the result is a calendarDay
+func parseNaturalDate(text string, now time.Time) (time.Time, bool) {
+	text = strings.Trim(strings.ToLower(strings.Join(strings.Fields(text), " ")), ".!")
+	text = strings.TrimPrefix(text, "в ")
+	text = strings.TrimPrefix(text, "во ")
+	loc := time.UTC
+	today := calendarDay(now)
+
+	switch text {
+	case "сегодня":
+		return today, true
+	case "завтра":
+		return today.AddDate(0, 0, 1), true
+	case "послезавтра":
+		return today.AddDate(0, 0, 2), true
+	}
+
+	if weekday, ok := weekdayNames[text]; ok {
+		days := (int(weekday) - int(today.Weekday()) + 7) % 7
+		if days == 0 {
+			days = 7
+		}
+		return today.AddDate(0, 0, days), true
+	}
+
+	if m := relativeDateRe.FindStringSubmatch(text); m != nil {
+		n := 1
+		if m[1] != "" {
+			n, _ = strconv.Atoi(m[1])
+		}
+		switch {
+		case strings.HasPrefix(m[2], "д"): // день, дня, дней
+			return today.AddDate(0, 0, n), true
+		case strings.HasPrefix(m[2], "недел"):
+			return today.AddDate(0, 0, 7*n), true
+		case strings.HasPrefix(m[2], "месяц"):
+			return today.AddDate(0, n, 0), true
+		}
+		return time.Time{}, false
+	}
+
+	if date, err := time.ParseInLocation("2006-01-02", text, loc); err == nil {
+		return date, true
+	}
+
+	var day, year int
+	var month time.Month
+	if m := numericDateRe.FindStringSubmatch(text); m != nil {
+		day, _ = strconv.Atoi(m[1])
+		monthNumber, _ := strconv.Atoi(m[2])
+		month = time.Month(monthNumber)
+		year, _ = strconv.Atoi(m[3])
+	} else if m := textualDateRe.FindStringSubmatch(text); m != nil {
+		var ok bool
+		if month, ok = monthNames[m[2]]; !ok {
+			return time.Time{}, false
+		}
+		day, _ = strconv.Atoi(m[1])
+		year, _ = strconv.Atoi(m[3])
+	} else {
+		return time.Time{}, false
+	}
+
+	if year != 0 && year < 100 {
+		year += 2000
+	}
+	yearGiven := year != 0
+	if !yearGiven {
+		year = today.Year()
+	}
+
+	date := time.Date(year, month, day, 0, 0, 0, 0, loc)
+	if date.Day() != day || date.Month() != month {
+		return time.Time{}, false // e.g. 31.02
+	}
+	// a date without a year means the nearest one in the future
+	if !yearGiven && date.Before(today) {
+		date = date.AddDate(1, 0, 0)
+	}
+	return date, true
+}
+
+// formatDateWithWeekday formats a date for confirmation messages, e.g. "пт, 20.11.2026"
+func formatDateWithWeekday(date time.Time) string {
+	return weekdayShortNames[date.Weekday()] + ", " + date.Format("02.01.2006")
+}
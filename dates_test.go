@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseNaturalDate(t *testing.T) {
+	now := time.Date(2026, 11, 18, 10, 30, 0, 0, time.FixedZone("MSK", 3*60*60)) // wednesday
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		text string
+		want time.Time
+	}{
+		{"сегодня", day(2026, 11, 18)},
+		{"Завтра.", day(2026, 11, 19)},
+		{"послезавтра", day(2026, 11, 20)},
+		{"в пятницу", day(2026, 11, 20)},
+		{"во вторник", day(2026, 11, 24)},
+		{"в среду", day(2026, 11, 25)},
+		{"через неделю", day(2026, 11, 25)},
+		{"через 3 дня", day(2026, 11, 21)},
+		{"через  2 месяца", day(2027, 1, 18)},
+		{"20.11", day(2026, 11, 20)},
+		{"17/11", day(2027, 11, 17)},
+		{"01.02", day(2027, 2, 1)},
+		{"20.11.27", day(2027, 11, 20)},
+		{"20 ноября", day(2026, 11, 20)},
+		{"5 января 2027", day(2027, 1, 5)},
+		{"2026-12-01", day(2026, 12, 1)},
+	}
+	for _, tt := range tests {
+		got, ok := parseNaturalDate(tt.text, now)
+		if !ok || !got.Equal(tt.want) || got.Location() != time.UTC {
+			t.Errorf("parseNaturalDate(%q) = %v, %v, want %v", tt.text, got, ok, tt.want)
+		}
+	}
+
+	for _, text := range []string{"", "31.02", "20 нобря", "через 2 года", "завтра утром", "13.13"} {
+		if got, ok := parseNaturalDate(text, now); ok {
+			t.Errorf("parseNaturalDate(%q) = %v, want no date", text, got)
+		}
+	}
+}
+
+func TestTypedAndPickedDatesMix(t *testing.T) {
+	// late evening in Moscow is already the next day than in UTC, the typed date must still be the Moscow one
+	now := time.Date(2026, 11, 18, 23, 30, 0, 0, time.FixedZone("MSK", 3*60*60))
+	typed, ok := parseNaturalDate("завтра", now)
+	if !ok || !typed.Equal(time.Date(2026, 11, 19, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("parseNaturalDate(завтра) = %v, %v", typed, ok)
+	}
+
+	// the datepicker answers with midnight of the server timezone, here one west of UTC
+	picked := time.Date(2026, 12, 2, 0, 0, 0, 0, time.FixedZone("EST", -5*60*60))
+	form := Form{DepartureDate: typed, DepartureDateTo: calendarDay(picked)}
+	if form.DepartureDateTo.After(form.DepartureDate.AddDate(0, 0, 13)) {
+		t.Errorf("range %v – %v is longer than 2 weeks", form.DepartureDate, form.DepartureDateTo)
+	}
+	if got := formDatesString(form); got != "19.11–02.12.2026" {
+		t.Errorf("formDatesString = %q", got)
+	}
+	if !dateSaleOpening(form.DepartureDate).Equal(dateSaleOpening(calendarDay(time.Date(2026, 11, 19, 0, 0, 0, 0, time.Local)))) {
+		t.Errorf("sale opening differs between a typed and a picked date")
+	}
+
+	if got := pickerDay(typed); got.Location() != time.Local || got.Day() != 19 {
+		t.Errorf("pickerDay = %v", got)
+	}
+}
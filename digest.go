@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	digestDailyHour       = 9 // the daily digest goes out at this hour of the user timezone
+	digestCheckInterval   = time.Minute
+	maxMessageLength      = 4096
+	digestEntrySeparator  = "\n\n———\n\n"
+	defaultDigestInterval = 30
+	formSweepInterval     = 10 * time.Minute // expired forms are archived and missing monitors started this often
+)
+
+// inQuietHours reports if now falls in the quiet hours of the user
+func inQuietHours(session Session, now time.Time) bool {
+	if !session.QuietHours.isSet() {
+		return false
+	}
+	local := now.In(sessionLocation(session))
+	return session.QuietHours.contains(local.Hour()*60 + local.Minute())
+}
+
+// deliverNotification queues a notification about the form now, or holds it back for the digest or the end of the
+// quiet hours
+func deliverNotification(chatID int64, form Form, event, text string, silent bool) {
+	session, err := getSession(chatID)
+	if err != nil {
+		log.Println("Error: could not get session for notification settings: ", err)
+		enqueueChangeNotification(chatID, form, event, text, silent)
+		return
+	}
+
+	now := time.Now()
+	notification := PendingNotification{Time: now, EventID: event, FormID: form.ID, Text: text}
+	if session.DigestMode == DigestInterval || session.DigestMode == DigestDaily {
+		appendPendingNotification(chatID, notification, false)
+		return
+	}
+	if inQuietHours(session, now) {
+		if session.QuietMode == QuietHold {
+			appendPendingNotification(chatID, notification, true)
+			return
+		}
+		silent = true
+	}
+
+	enqueueChangeNotification(chatID, form, event, text, silent)
+}
+
+// digestDue reports if the collected notifications should go out as a digest now
+func digestDue(session Session, pending PendingNotifications, now time.Time) bool {
+	if len(pending.Digest) == 0 {
+		return false
+	}
+
+	switch session.DigestMode {
+	case DigestInterval:
+		since := pending.LastDigest
+		if since.IsZero() {
+			since = pending.Digest[0].Time
+		}
+		return now.Sub(since) >= time.Duration(session.DigestEvery)*time.Minute
+	case DigestDaily:
+		loc := sessionLocation(session)
+		local := now.In(loc)
+		slot := time.Date(local.Year(), local.Month(), local.Day(), digestDailyHour, 0, 0, 0, loc)
+		if local.Before(slot) {
+			slot = slot.AddDate(0, 0, -1)
+		}
+		return pending.LastDigest.Before(slot) && pending.Digest[0].Time.Before(slot)
+	}
+
+	// the digest was turned off with notifications still collected
+	return true
+}
+
+// joinWithinLimit joins the texts into one message, dropping the ones that do not fit
+func joinWithinLimit(header string, texts []string) string {
+	message := header
+	for i, text := range texts {
+		more := fmt.Sprintf("%s…и ещё %d", digestEntrySeparator, len(texts)-i)
+		if len(message)+len(digestEntrySeparator)+len(text)+len(more) > maxMessageLength {
+			return message + more
+		}
+		message += digestEntrySeparator + text
+	}
+	return message
+}
+
+// flushPendingNotifications sends the held notifications once the quiet hours are over, and the digest when it is due
+func flushPendingNotifications(chatID int64, now time.Time) {
+	session, err := getSession(chatID)
+	if err != nil {
+		log.Println("Error: could not get session while flushing notifications: ", err)
+		return
+	}
+
+	quiet := inQuietHours(session, now)
+	hold := quiet && session.QuietMode == QuietHold
+
+	var held, digest []PendingNotification
+	err = updatePendingNotifications(chatID, func(pending *PendingNotifications) {
+		if hold {
+			return
+		}
+		held, pending.Held = pending.Held, nil
+		if digestDue(session, *pending, now) {
+			digest, pending.Digest = pending.Digest, nil
+			pending.LastDigest = now
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	for _, notification := range held {
+		// the buttons of the form go with it, unless the form is gone by now
+		form, err := getFormByID(chatID, notification.FormID)
+		if err != nil {
+			enqueueMessage(chatID, notification.EventID, notification.Text, false)
+			continue
+		}
+		enqueueChangeNotification(chatID, form, notification.EventID, notification.Text, false)
+	}
+
+	if len(digest) > 0 {
+		texts := []string{}
+		for _, notification := range digest {
+			texts = append(texts, notification.Text)
+		}
+		enqueueMessage(chatID, eventID("digest", chatID, now), joinWithinLimit(fmt.Sprintf("📋 Сводка изменений: %d", len(digest)), texts), quiet)
+	}
+}
+
+// runNotificationScheduler periodically flushes the pending notifications of every chat and sweeps the forms,
+// until ctx is done
+func runNotificationScheduler(ctx context.Context) {
+	ticker := time.NewTicker(digestCheckInterval)
+	defer ticker.Stop()
+	sweepTicker := time.NewTicker(formSweepInterval)
+	defer sweepTicker.Stop()
+
+	// monitors do not survive a restart
+	go sweepForms()
+
+	for {
+		select {
+		case <-ticker.C:
+			chatIDs, err := getPendingChats()
+			if err != nil {
+				continue
+			}
+			for _, chatID := range chatIDs {
+				flushPendingNotifications(chatID, time.Now())
+			}
+		case <-sweepTicker.C:
+			sweepForms()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// notificationSettingsString describes the quiet hours and digest settings of the user
+func notificationSettingsString(session Session) string {
+	quiet := "Тихие часы: выключены"
+	if session.QuietHours.isSet() {
+		mode := session.QuietMode
+		if mode == "" {
+			mode = QuietSilent
+		}
+		quiet = fmt.Sprintf("Тихие часы: %s, %s", session.QuietHours, strings.ToLower(mode.Label()))
+	}
+
+	digest := "Дайджест: выключен"
+	switch session.DigestMode {
+	case DigestInterval:
+		digest = fmt.Sprintf("Дайджест: каждые %d мин", session.DigestEvery)
+	case DigestDaily:
+		digest = fmt.Sprintf("Дайджест: раз в день в %02d:00", digestDailyHour)
+	}
+
+	return quiet + "\n" + digest
+}
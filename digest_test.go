@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInQuietHours(t *testing.T) {
+	session := Session{Timezone: "UTC", QuietHours: TimeWindow{From: 23 * 60, To: 8 * 60}}
+	tests := []struct {
+		now  time.Time
+		want bool
+	}{
+		{time.Date(2026, 11, 20, 23, 30, 0, 0, time.UTC), true},
+		{time.Date(2026, 11, 20, 7, 59, 0, 0, time.UTC), true},
+		{time.Date(2026, 11, 20, 12, 0, 0, 0, time.UTC), false},
+		// 21:00 UTC is 00:00 in Moscow
+		{time.Date(2026, 11, 20, 21, 0, 0, 0, time.UTC), false},
+	}
+	for _, tt := range tests {
+		if got := inQuietHours(session, tt.now); got != tt.want {
+			t.Errorf("inQuietHours(%v) = %v, want %v", tt.now, got, tt.want)
+		}
+	}
+
+	moscow := session
+	moscow.Timezone = "Europe/Moscow"
+	if !inQuietHours(moscow, time.Date(2026, 11, 20, 21, 0, 0, 0, time.UTC)) {
+		t.Errorf("inQuietHours: 00:00 in Moscow is not quiet")
+	}
+	if inQuietHours(Session{}, time.Date(2026, 11, 20, 23, 30, 0, 0, time.UTC)) {
+		t.Errorf("inQuietHours without quiet hours is quiet")
+	}
+}
+
+func TestDigestDue(t *testing.T) {
+	utc := func(day, hour, minute int) time.Time { return time.Date(2026, 11, day, hour, minute, 0, 0, time.UTC) }
+	entry := func(at time.Time) []PendingNotification { return []PendingNotification{{Time: at}} }
+	interval := Session{Timezone: "UTC", DigestMode: DigestInterval, DigestEvery: 30}
+	daily := Session{Timezone: "UTC", DigestMode: DigestDaily}
+
+	tests := []struct {
+		name    string
+		session Session
+		pending PendingNotifications
+		now     time.Time
+		want    bool
+	}{
+		{"nothing collected", interval, PendingNotifications{}, utc(20, 12, 0), false},
+		{"interval not over", interval, PendingNotifications{Digest: entry(utc(20, 12, 0))}, utc(20, 12, 29), false},
+		{"interval over since first entry", interval, PendingNotifications{Digest: entry(utc(20, 12, 0))}, utc(20, 12, 30), true},
+		{"interval counts from last digest", interval, PendingNotifications{Digest: entry(utc(20, 12, 20)), LastDigest: utc(20, 12, 0)}, utc(20, 12, 30), true},
+		{"daily before the hour", daily, PendingNotifications{Digest: entry(utc(20, 7, 0)), LastDigest: utc(19, 9, 0)}, utc(20, 8, 59), false},
+		{"daily at the hour", daily, PendingNotifications{Digest: entry(utc(20, 7, 0)), LastDigest: utc(19, 9, 0)}, utc(20, 9, 0), true},
+		{"daily already sent", daily, PendingNotifications{Digest: entry(utc(20, 9, 30)), LastDigest: utc(20, 9, 0)}, utc(20, 15, 0), false},
+		{"daily entry after the slot waits", daily, PendingNotifications{Digest: entry(utc(20, 10, 0))}, utc(20, 23, 0), false},
+		{"digest turned off", Session{}, PendingNotifications{Digest: entry(utc(20, 12, 0))}, utc(20, 12, 1), true},
+	}
+	for _, tt := range tests {
+		if got := digestDue(tt.session, tt.pending, tt.now); got != tt.want {
+			t.Errorf("%s: digestDue = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestJoinWithinLimit(t *testing.T) {
+	short := []string{"a", "b"}
+	if got, want := joinWithinLimit("H", short), "H"+digestEntrySeparator+"a"+digestEntrySeparator+"b"; got != want {
+		t.Errorf("joinWithinLimit = %q, want %q", got, want)
+	}
+
+	long := strings.Repeat("x", 1500)
+	texts := []string{long, long, long, long}
+	got := joinWithinLimit("H", texts)
+	if len(got) > maxMessageLength {
+		t.Errorf("joinWithinLimit is %d bytes, over %d", len(got), maxMessageLength)
+	}
+	if !strings.HasSuffix(got, "…и ещё 2") {
+		t.Errorf("joinWithinLimit = %q…, want the two dropped entries counted", got[len(got)-40:])
+	}
+	if strings.Count(got, long) != 2 {
+		t.Errorf("joinWithinLimit kept %d entries, want 2", strings.Count(got, long))
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -14,45 +16,171 @@ import (
 	"golang.org/x/net/html"
 )
 
-var monitoringCancelFuncs = make(map[int]context.CancelFunc)
+// data-table values of the price spans grandtrain uses for each carriage class
+var grandtrainTables = map[CarriageType]string{
+	CarriagePlackart: "Плац",
+	CarriageKupe:     "Купе",
+	CarriageSV:       "СВ",
+	CarriageLux:      "Люкс",
+	CarriageSitting:  "Сид",
+}
+
+// form IDs are only unique within a chat
+type monitoringKey struct {
+	chatID int64
+	formID int
+}
+
+var monitoringCancelFuncs = make(map[monitoringKey]context.CancelFunc)
+var monitoringMutex sync.Mutex
 var monitoringWaitGroup sync.WaitGroup
 
 func startMonitoring(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, form Form) {
-	ctxm, cancel := context.WithCancel(context.Background())
-	monitoringCancelFuncs[form.ID] = cancel
-	monitoringWaitGroup.Add(1)
-	doc, err := fetchHTML(form)
-	if err != nil {
-		log.Println("Error: getting html")
+	if !launchMonitor(chatID, form) {
 		return
 	}
-	initFormState, err := getFromState(doc, form)
+
+	if time.Now().Before(saleOpening(form)) {
+		session, err := getSession(chatID)
+		if err != nil {
+			log.Println("Error: could not get session: ", err)
+			return
+		}
+		sendMessage(ctx, b, update, fmt.Sprintf("Продажа билетов на %s откроется %s. До этого форма %d ждёт, накануне я напомню.", formDatesString(form), saleOpeningString(form, sessionLocation(session)), form.ID))
+	}
+}
+
+// launchMonitor polls the form once and starts its monitor, reports if it did. a form has one monitor at most,
+// a second start (e.g. a resume of a running form) is refused
+func launchMonitor(chatID int64, form Form) bool {
+	if err := form.Validate(); err != nil {
+		log.Printf("Error: not monitoring invalid form %d (chat %d): %v", form.ID, chatID, err)
+		return false
+	}
+	if form.Inactive {
+		log.Printf("Not monitoring form %d of chat %d, the chat blocked the bot", form.ID, chatID)
+		return false
+	}
+
+	key := monitoringKey{chatID, form.ID}
+	ctxm, cancel := context.WithCancel(context.Background())
+	monitoringMutex.Lock()
+	if _, ok := monitoringCancelFuncs[key]; ok {
+		monitoringMutex.Unlock()
+		cancel()
+		log.Printf("Form %d (chat %d) is already monitored", form.ID, chatID)
+		return false
+	}
+	monitoringCancelFuncs[key] = cancel
+	monitoringMutex.Unlock()
+
+	initFormState, err := fetchFormState(form, FormState{}, time.Now())
 	if err != nil {
 		log.Print("Error: getting form state 1: ", err)
-		return
+		stopMonitoring(chatID, form.ID)
+		return false
 	}
 
-	session, err := getSession(chatID)
+	setFormState(chatID, form.ID, initFormState)
+
+	appendFormHistory(chatID, form.ID, initFormState, time.Now())
+	recordCheck(chatID, form.ID, initFormState)
+	markStatusChanged(chatID)
+
+	monitoringWaitGroup.Add(1)
+	go monitorForm(ctxm, chatID, form, initFormState)
+	return true
+}
+
+// isMonitored reports if the form has a running monitor
+func isMonitored(chatID int64, formID int) bool {
+	monitoringMutex.Lock()
+	defer monitoringMutex.Unlock()
+	_, ok := monitoringCancelFuncs[monitoringKey{chatID, formID}]
+	return ok
+}
+
+// sweepForms archives the forms whose departure passed, paused ones too, and starts the monitors missing after a
+// restart or a failed start
+func sweepForms() {
+	chatIDs, err := getSessionChats()
 	if err != nil {
-		log.Println("Error: could not get session: ", err)
 		return
 	}
 
-	updatedSessionFormsStatus := append(session.FormsStatus, initFormState)
-	updateSession(chatID, SessionUpdate{FormsStatus: &updatedSessionFormsStatus})
+	now := time.Now()
+	for _, chatID := range chatIDs {
+		session, err := getSession(chatID)
+		if err != nil {
+			continue
+		}
+		for _, form := range savedForms(session) {
+			switch {
+			case departurePassed(form, now):
+				expireForm(chatID, form, priceUnknown)
+			case !form.Paused && !form.Inactive && !isMonitored(chatID, form.ID):
+				launchMonitor(chatID, form)
+			}
+		}
+	}
+}
 
-	go monitorForm(ctxm, ctx, b, update, chatID, form, initFormState)
+func stopMonitoring(chatID int64, formID int) {
+	monitoringMutex.Lock()
+	defer monitoringMutex.Unlock()
 
+	key := monitoringKey{chatID, formID}
+	if cancelFunc, ok := monitoringCancelFuncs[key]; ok {
+		log.Printf("Stopping monitoring for form %d (chat %d)", formID, chatID)
+		cancelFunc()
+		delete(monitoringCancelFuncs, key)
+		forgetCheck(chatID, formID)
+		markStatusChanged(chatID)
+	} else {
+		log.Printf("No active monitoring found for form %d (chat %d)", formID, chatID)
+	}
 }
 
-func stopMonitoring(formID int) {
-	if cancelFunc, ok := monitoringCancelFuncs[formID]; ok {
-		fmt.Printf("Stopping monitoring for form %d...\n", formID)
+// stopAllMonitoring cancels every monitor and waits until they return, so none of them uses the db after it is closed
+func stopAllMonitoring() {
+	monitoringMutex.Lock()
+	for key, cancelFunc := range monitoringCancelFuncs {
 		cancelFunc()
-		delete(monitoringCancelFuncs, formID)
+		delete(monitoringCancelFuncs, key)
+	}
+	monitoringMutex.Unlock()
+
+	monitoringWaitGroup.Wait()
+}
+
+// departurePassed reports if the last departure date of the form is over
+func departurePassed(form Form, now time.Time) bool {
+	last := form.DepartureDate
+	if !form.DepartureDateTo.IsZero() {
+		last = form.DepartureDateTo
+	}
+	return !now.Before(last.AddDate(0, 0, 1))
+}
+
+// expireForm stops monitoring the form, moves it to the archive and sends the final summary
+func expireForm(chatID int64, form Form, lowest Price) {
+	if historyLowest, err := lowestHistoryPrice(chatID, form.ID); err == nil && historyLowest.Less(lowest) {
+		lowest = historyLowest
+	}
+	if err := archiveForm(chatID, form.ID, lowest); err != nil {
+		log.Printf("Error: could not archive form %d (chat %d): %v", form.ID, chatID, err)
+		return
+	}
+	stopMonitoring(chatID, form.ID)
+
+	text := fmt.Sprintf("Форма %d (%s → %s, %s) завершена: дата отправления прошла.", form.ID, form.DeparturePoint, form.ArrivalPoint, formDatesString(form))
+	if lowest.Available() {
+		text += fmt.Sprintf("\nСамая низкая цена за время отслеживания: %s", lowest)
 	} else {
-		fmt.Printf("No active monitoring found for form %d\n", formID)
+		text += "\nБилетов за время отслеживания не было."
 	}
+	text += "\nАрхив форм: /list archived"
+	deliverNotification(chatID, form, eventID("expired", chatID, form.ID), text, false)
 }
 
 func fetchHTML(form Form) (*html.Node, error) {
@@ -72,6 +200,181 @@ func fetchHTML(form Form) (*html.Node, error) {
 	return doc, nil
 }
 
+const maxFetchesPerPoll = 2 // requests to grandtrain per poll of one form, the other dates wait for the next polls
+
+// one date the form polls: a departure date (index in formDates) or the return date
+type pollTarget struct {
+	index   int // -1 for the return date
+	date    time.Time
+	checked time.Time
+}
+
+// pollTargets lists the dates due for a poll, the least recently checked first. right after the sale of some
+// dates opened only those are polled
+func pollTargets(form Form, state FormState, now time.Time) []pollTarget {
+	targets := []pollTarget{}
+	for i, date := range formDates(form) {
+		checked := state.Checked
+		if i < len(state.DatePrices) {
+			checked = state.DatePrices[i].Checked
+		}
+		targets = append(targets, pollTarget{index: i, date: date, checked: checked})
+	}
+	if form.RoundTrip {
+		targets = append(targets, pollTarget{index: -1, date: form.ReturnDate, checked: state.ReturnChecked})
+	}
+
+	opening := []pollTarget{}
+	for _, target := range targets {
+		if saleJustOpened(target.date, now) {
+			opening = append(opening, target)
+		}
+	}
+	if len(opening) > 0 {
+		targets = opening
+	}
+
+	sort.SliceStable(targets, func(i, j int) bool { return targets[i].checked.Before(targets[j].checked) })
+	return targets
+}
+
+// fetchFormState polls the dates of the form that are due and carries the others over from prev. a date range
+// is covered by the date strip of one response where possible, at most maxFetchesPerPoll requests are made and
+// only while grandtrainBudget allows. dates not on sale yet are not fetched
+func fetchFormState(form Form, prev FormState, now time.Time) (FormState, error) {
+	state := prev
+	state.Date = form.DepartureDate
+	if state.Checked.IsZero() {
+		state.Price = priceUnknown
+	}
+	if form.RoundTrip {
+		state.ReturnDate = form.ReturnDate
+		if state.ReturnChecked.IsZero() {
+			state.ReturnPrice = priceUnknown
+		}
+	}
+	state.DatePrices = nil
+	if !form.DepartureDateTo.IsZero() {
+		for i, date := range formDates(form) {
+			datePrice := DatePrice{Date: date, Price: priceUnknown}
+			if i < len(prev.DatePrices) && prev.DatePrices[i].Date.Equal(date) {
+				datePrice = prev.DatePrices[i]
+			}
+			state.DatePrices = append(state.DatePrices, datePrice)
+		}
+	}
+
+	fetches := 0
+	var docs []*html.Node
+	for _, target := range pollTargets(form, state, now) {
+		if now.Before(dateSaleOpening(target.date)) {
+			if target.index == -1 {
+				state.ReturnPrice, state.ReturnChecked = priceNotOnSale, now
+			} else {
+				setDatePrice(&state, target.index, DatePrice{Date: target.date, Price: priceNotOnSale, Checked: now})
+			}
+			continue
+		}
+
+		if target.index == -1 {
+			if fetches >= maxFetchesPerPoll || !grandtrainBudget.take(now) {
+				continue
+			}
+			fetches++
+			price, err := fetchReturnPrice(form)
+			if err != nil {
+				return FormState{}, err
+			}
+			state.ReturnPrice, state.ReturnChecked = price, now
+			continue
+		}
+
+		dateForm := form
+		dateForm.DepartureDate = target.date
+		date := target.date.Format("2006-01-02")
+
+		// every date has its own train list, without filters the date strip of an earlier response may do
+		var entries [][]ClassPrice
+		var doc *html.Node
+		if !hasTrainFilters(form) {
+			for _, d := range docs {
+				if entries = findDateEntries(d, date); len(entries) > 0 {
+					doc = d
+					break
+				}
+			}
+		}
+		if doc == nil {
+			if fetches >= maxFetchesPerPoll || !grandtrainBudget.take(now) {
+				continue
+			}
+			fetches++
+			d, err := fetchHTML(dateForm)
+			if err != nil {
+				return FormState{}, err
+			}
+			doc = d
+			docs = append(docs, d)
+			entries = findDateEntries(d, date)
+		}
+
+		datePrice := DatePrice{Date: target.date, Price: priceNotOnSale, Checked: now}
+		if len(entries) > 0 {
+			datePrice.Price, datePrice.Seats = formPrice(form, entries[0]), formSeats(form, entries[0])
+		}
+		var trains []Train
+		if hasTrainFilters(form) {
+			// with filters the price comes from the matching trains of the train list instead of the date strip
+			datePrice.Price, trains = filteredPrice(form, parseTrains(doc))
+			datePrice.Seats = trainsSeats(form, trains)
+		}
+		setDatePrice(&state, target.index, datePrice)
+		if target.index == 0 {
+			state.ClassPrices, state.Trains = nil, trains
+			if len(entries) > 0 {
+				state.ClassPrices = entries[0]
+			}
+		}
+	}
+
+	return state, nil
+}
+
+// setDatePrice stores the polled price of the departure date with the index in formDates, the first date is
+// also the price of the state
+func setDatePrice(state *FormState, index int, datePrice DatePrice) {
+	if index < len(state.DatePrices) {
+		state.DatePrices[index] = datePrice
+	}
+	if index == 0 {
+		state.Price, state.Seats, state.Checked = datePrice.Price, datePrice.Seats, datePrice.Checked
+	}
+}
+
+// returnLegForm is the return trip of a round trip form as a one-way form
+func returnLegForm(form Form) Form {
+	leg := form
+	leg.DeparturePoint, leg.ArrivalPoint = form.ArrivalPoint, form.DeparturePoint
+	leg.DepartureDate, leg.DepartureDateTo = form.ReturnDate, time.Time{}
+	leg.RoundTrip = false
+	return leg
+}
+
+// fetchReturnPrice fetches the return leg on its own, so a return on the departure date is not mixed up with it
+func fetchReturnPrice(form Form) (Price, error) {
+	leg := returnLegForm(form)
+	doc, err := fetchHTML(leg)
+	if err != nil {
+		return Price{}, err
+	}
+	entries := findDateEntries(doc, leg.DepartureDate.Format("2006-01-02"))
+	if len(entries) == 0 {
+		return priceNotOnSale, nil
+	}
+	return formPrice(leg, entries[0]), nil
+}
+
+// every request is one-way, the return leg of a round trip is fetched with returnLegForm
 func getFormUrlParams(form Form) string {
 	return fmt.Sprintf("from=%s&to=%s&forward_date=%s&backward_date=&multimodal=0pagestyle=tav&timeout=10", cities[form.DeparturePoint], cities[form.ArrivalPoint], form.DepartureDate.Format("02.01.2006"))
 }
@@ -88,12 +391,82 @@ func getTextContent(n *html.Node) string {
 	return strings.TrimSpace(text)
 }
 
-// getFromState extracts the price string for the current date from the parsed HTML.
-func getFromState(doc *html.Node, form Form) (FormState, error) {
-	departureDate := form.DepartureDate.Format("2006-01-02")
-	var formState FormState
-	formState.Date = form.DepartureDate
-	var foundPrice bool
+// formPrice picks the price of the form carriage class from a date strip entry, the cheapest class for CarriageAny.
+// sold out if the class is not in the entry or none of its free seats fits the form
+func formPrice(form Form, classPrices []ClassPrice) Price {
+	price := priceSoldOut
+	for _, classPrice := range classPrices {
+		if _, fits := matchingSeats(form, classPrice); !fits {
+			continue
+		}
+		if form.CarriageType != CarriageAny {
+			if classPrice.Class == form.CarriageType {
+				return classPrice.Price
+			}
+			continue
+		}
+		if classPrice.Price.Less(price) {
+			price = classPrice.Price
+		}
+	}
+	return price
+}
+
+// formSeats counts the free seats of the form carriage class in a date strip entry, of all classes for CarriageAny
+func formSeats(form Form, classPrices []ClassPrice) int {
+	seats := 0
+	for _, classPrice := range classPrices {
+		if classPrice.Price.Available() && (form.CarriageType == CarriageAny || classPrice.Class == form.CarriageType) {
+			n, _ := matchingSeats(form, classPrice)
+			seats += n
+		}
+	}
+	return seats
+}
+
+// matchingSeats counts the free seats of the class that fit the compartments and shelves of the form, and reports
+// if any does. without seat numbers all free seats count
+func matchingSeats(form Form, classPrice ClassPrice) (int, bool) {
+	if classPrice.FreeSeats == nil {
+		return classPrice.Seats, true
+	}
+	n := 0
+	for _, seat := range classPrice.FreeSeats {
+		if seatMatchesForm(form, classPrice.Class, seat) {
+			n++
+		}
+	}
+	return n, n > 0
+}
+
+// priceSeats reads the free seat count of a price span, 0 if the span has none
+func priceSeats(span *html.Node) int {
+	val, ok := getAttributeValue(span, "data-seats")
+	if !ok {
+		return 0
+	}
+	seats, _ := strconv.Atoi(strings.TrimSpace(val))
+	return seats
+}
+
+// priceFreeSeats reads the free seat numbers of a price span, "1,5,37", nil if the span has none
+func priceFreeSeats(span *html.Node) []int {
+	val, ok := getAttributeValue(span, "data-places")
+	if !ok {
+		return nil
+	}
+	seats := []int{}
+	for _, field := range strings.Split(val, ",") {
+		if seat, err := strconv.Atoi(strings.TrimSpace(field)); err == nil {
+			seats = append(seats, seat)
+		}
+	}
+	return seats
+}
+
+// findDateEntries collects, in document order, the class prices of all date strip entries for date ("2006-01-02").
+func findDateEntries(doc *html.Node, date string) [][]ClassPrice {
+	var entries [][]ClassPrice
 
 	// Function to recursively traverse the HTML nodes.
 	var traverse func(*html.Node)
@@ -101,35 +474,34 @@ func getFromState(doc *html.Node, form Form) (FormState, error) {
 		if n.Type == html.ElementNode && n.Data == "a" {
 			// Check if this is the <a> element we're interested in.
 			thisDate, ok := getAttributeValue(n, "data-thisdate")
-			if ok && thisDate == departureDate {
-				// Found the correct <a> tag.
+			if ok && thisDate == date {
+				classPrices := []ClassPrice{}
 				priceDiv := findChildWithTag(n, "div", "otherprices__detail-price")
 				if priceDiv != nil {
-					priceSpan := findChildWithAttribute(priceDiv, "span", "data-table", "Плац")
-					if priceSpan != nil {
-						formState.Price = getTextContent(priceSpan) // Get the price string directly
-						foundPrice = true
-						return // Stop traversing once we find the price.
+					for _, carriageType := range carriageTypes {
+						table, ok := grandtrainTables[carriageType]
+						if !ok {
+							continue
+						}
+						priceSpan := findChildWithAttribute(priceDiv, "span", "data-table", table)
+						if priceSpan != nil {
+							classPrices = append(classPrices, ClassPrice{Class: carriageType, Price: parsePrice(getTextContent(priceSpan)), Seats: priceSeats(priceSpan), FreeSeats: priceFreeSeats(priceSpan)})
+						}
 					}
 				}
+				entries = append(entries, classPrices)
+				return
 			}
 		}
 		// Continue traversing the children of the current node.
 		for c := n.FirstChild; c != nil; c = c.NextSibling {
 			traverse(c)
-			if foundPrice {
-				return // Stop traversing if we've found the price.
-			}
 		}
 	}
 
 	traverse(doc) // Start the traversal from the root of the document.
 
-	if !foundPrice {
-		return FormState{Date: form.DepartureDate, Price: "-"}, nil
-	}
-
-	return formState, nil
+	return entries
 }
 
 // getAttributeValue retrieves the value of a specific attribute from an HTML node.
@@ -170,40 +542,97 @@ func findChildWithTag(n *html.Node, tag, class string) *html.Node {
 	return nil
 }
 
-func monitorForm(ctxm, ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, form Form, initialFormState FormState) {
-	ticker := time.NewTicker(2 * time.Second)
-	defer ticker.Stop()
+func monitorForm(ctxm context.Context, chatID int64, form Form, initialFormState FormState) {
 	defer monitoringWaitGroup.Done()
 
+	// nothing to poll before the date goes on sale
+	if !waitForSaleOpening(ctxm, chatID, form) {
+		log.Printf("Monitoring stopped for form %d (chat %d)", form.ID, chatID)
+		return
+	}
+
+	ticker := time.NewTicker(nextPollInterval(form, time.Now(), pollJitter()))
+	defer ticker.Stop()
+	lowest := bestPrice(initialFormState)
+	polled := initialFormState // dates not polled this time are carried over from the last poll
+	// last reported side of the price ceiling. an offer already under it when tracking starts is reported right away
+	ceilingBelow := underPriceCeiling(form, initialFormState)
+	if ceilingBelow {
+		deliverNotification(chatID, form, eventID("under-ceiling", chatID, form.ID, bestPrice(initialFormState)), underCeilingNotification(form, initialFormState), false)
+	}
+	budgetWithin := withinRoundTripBudget(form, initialFormState)
+
 	for {
 		select {
 		case <-ticker.C:
-			doc, err := fetchHTML(form)
+			if departurePassed(form, time.Now()) {
+				expireForm(chatID, form, lowest)
+				return
+			}
+			ticker.Reset(nextPollInterval(form, time.Now(), pollJitter()))
+			newFormState, err := fetchFormState(form, polled, time.Now())
 			if err != nil {
 				log.Printf("Error fetching for form %d (chat %d): %v", form.ID, chatID, err)
 				continue
 			}
+			polled = newFormState
+			recordCheck(chatID, form.ID, newFormState)
+			if price := bestPrice(newFormState); price.Less(lowest) {
+				lowest = price
+			}
 
-			updated := false
+			// changes below the threshold keep the old price in the baseline, so slow drifts still add up to an alert
+			baseline, updated := advanceBaseline(form, initialFormState, newFormState)
 
-			newFormState, err := getFromState(doc, form)
-			if err != nil {
-				log.Println("Error: getting form state: ", err)
-				return
+			// the ceiling is checked on every poll, a crossing is reported even if the change is below the threshold
+			crossed := false
+			if form.PriceCeiling > 0 && bestPrice(newFormState).Availability != Unknown {
+				below := underPriceCeiling(form, newFormState)
+				crossed, ceilingBelow = below != ceilingBelow, below
 			}
 
-			if newFormState.Price != initialFormState.Price {
-				updated = true
-				initialFormState.Price = newFormState.Price
+			if updated || crossed {
+				log.Printf("Update detected on form %d (%d)!", form.ID, chatID)
+				detected := time.Now()
+				// the poll time tells a change apart from the same change again later, the outbox sends each once
+				event := eventID("change", chatID, form.ID, detected)
+				appendFormHistory(chatID, form.ID, newFormState, detected)
+				markStatusChanged(chatID)
+
+				loc := time.Local
+				if session, err := getSession(chatID); err == nil {
+					loc = sessionLocation(session)
+				}
+				header, silent := transitionHeader(initialFormState, newFormState)
+				text := header + changeNotification(form, initialFormState, newFormState, detected.In(loc))
+
+				// with a price ceiling only offers at or below it are reported
+				switch {
+				case form.PriceCeiling == 0:
+					deliverNotification(chatID, form, event, text, silent)
+				case crossed && ceilingBelow:
+					deliverNotification(chatID, form, event, fmt.Sprintf("Цена не выше порога %d ₽ %s!\n%s", form.PriceCeiling, priceCeilingUnit(form), text), silent)
+				case crossed:
+					deliverNotification(chatID, form, eventID("above-ceiling", event), fmt.Sprintf("Цена снова выше порога %d ₽ %s.", form.PriceCeiling, priceCeilingUnit(form)), false)
+				case ceilingBelow:
+					deliverNotification(chatID, form, event, text, silent)
+				}
 			}
+			initialFormState = baseline
 
-			if updated {
-				log.Printf("Update detected on form %d (%d)!", form.ID, chatID)
-				sendMessage(ctx, b, update, "Изменение")
+			// the budget is checked on every poll too, only a crossing into it is reported
+			if form.RoundTrip && form.RoundTripBudget > 0 {
+				if total, ok := roundTripTotal(form, newFormState); ok {
+					within := withinRoundTripBudget(form, newFormState)
+					if within && !budgetWithin {
+						deliverNotification(chatID, form, eventID("budget", chatID, form.ID, total, time.Now()), fmt.Sprintf("Туда-обратно в пределах бюджета: %s ₽ (бюджет %d ₽)", formatAmount(total), form.RoundTripBudget), false)
+					}
+					budgetWithin = within
+				}
 			}
 
 		case <-ctxm.Done():
-			fmt.Printf("Monitoring stopped for form %d (chat %d)\n", form.ID, chatID)
+			log.Printf("Monitoring stopped for form %d (chat %d)", form.ID, chatID)
 			return
 		}
 	}
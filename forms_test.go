@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func loadFixture(t *testing.T, name string) *html.Node {
+	t.Helper()
+	f, err := os.Open("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	doc, err := html.Parse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestFindDateEntries(t *testing.T) {
+	doc := loadFixture(t, "grandtrain_dates.html")
+
+	tests := []struct {
+		date string
+		want []ClassPrice
+	}{
+		{"2026-11-19", []ClassPrice{
+			{Class: CarriagePlackart, Price: rublePrice(2345), Seats: 12},
+			{Class: CarriageKupe, Price: Price{Amount: 412050, Currency: "RUB", Availability: Available}, Seats: 3},
+			{Class: CarriageSV, Price: priceSoldOut},
+		}},
+		{"2026-11-20", []ClassPrice{
+			{Class: CarriagePlackart, Price: rublePrice(1990), Seats: 2, FreeSeats: []int{37, 38}},
+			{Class: CarriageSitting, Price: rublePrice(1150), Seats: 40},
+		}},
+		{"2026-11-21", []ClassPrice{}},
+	}
+	for _, tt := range tests {
+		entries := findDateEntries(doc, tt.date)
+		if len(entries) != 1 {
+			t.Fatalf("%s: %d entries, want 1", tt.date, len(entries))
+		}
+		got := entries[0]
+		if len(got) != len(tt.want) {
+			t.Fatalf("%s: got %+v, want %+v", tt.date, got, tt.want)
+		}
+		for i := range got {
+			if got[i].Class != tt.want[i].Class || got[i].Price != tt.want[i].Price || got[i].Seats != tt.want[i].Seats || len(got[i].FreeSeats) != len(tt.want[i].FreeSeats) {
+				t.Errorf("%s: class %d = %+v, want %+v", tt.date, i, got[i], tt.want[i])
+			}
+		}
+	}
+
+	if entries := findDateEntries(doc, "2026-11-22"); len(entries) != 0 {
+		t.Errorf("2026-11-22: got %d entries, want none", len(entries))
+	}
+}
+
+func TestFormPriceFromFixture(t *testing.T) {
+	doc := loadFixture(t, "grandtrain_dates.html")
+	entry := findDateEntries(doc, "2026-11-19")[0]
+
+	tests := []struct {
+		carriageType CarriageType
+		wantPrice    Price
+		wantSeats    int
+	}{
+		{CarriageAny, rublePrice(2345), 15},
+		{CarriagePlackart, rublePrice(2345), 12},
+		{CarriageKupe, Price{Amount: 412050, Currency: "RUB", Availability: Available}, 3},
+		{CarriageSV, priceSoldOut, 0},
+		{CarriageLux, priceSoldOut, 0},
+	}
+	for _, tt := range tests {
+		form := Form{CarriageType: tt.carriageType, CompartmentNumber: allCompartments(tt.carriageType), ShelfType: ShelfAny}
+		if got := formPrice(form, entry); got != tt.wantPrice {
+			t.Errorf("formPrice(%s) = %v, want %v", tt.carriageType, got, tt.wantPrice)
+		}
+		if got := formSeats(form, entry); got != tt.wantSeats {
+			t.Errorf("formSeats(%s) = %d, want %d", tt.carriageType, got, tt.wantSeats)
+		}
+	}
+}
+
+func TestFreeSeatsFromFixture(t *testing.T) {
+	doc := loadFixture(t, "grandtrain_dates.html")
+	entry := findDateEntries(doc, "2026-11-20")[0]
+
+	// only side seats 37 and 38 are free in the plackart class
+	notSide := Form{CarriageType: CarriagePlackart, CompartmentNumber: allCompartments(CarriagePlackart), ShelfType: ShelfAny, NoSideShefl: true}
+	if got := formPrice(notSide, entry); got != priceSoldOut {
+		t.Errorf("formPrice without side berths = %v, want sold out", got)
+	}
+	anySeat := notSide
+	anySeat.NoSideShefl = false
+	if got := formSeats(anySeat, entry); got != 2 {
+		t.Errorf("formSeats = %d, want 2", got)
+	}
+}
+
+func TestStopAllMonitoring(t *testing.T) {
+	stopped := make(chan struct{})
+	ctxm, cancel := context.WithCancel(context.Background())
+	monitoringMutex.Lock()
+	monitoringCancelFuncs[monitoringKey{8, 1}] = cancel
+	monitoringMutex.Unlock()
+
+	monitoringWaitGroup.Add(1)
+	go func() {
+		defer monitoringWaitGroup.Done()
+		<-ctxm.Done()
+		close(stopped)
+	}()
+
+	stopAllMonitoring()
+	select {
+	case <-stopped:
+	default:
+		t.Error("stopAllMonitoring returned before the monitor stopped")
+	}
+	if isMonitored(8, 1) {
+		t.Error("stopped form is still monitored")
+	}
+}
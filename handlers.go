@@ -10,6 +10,7 @@ import (
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
+	"github.com/go-telegram/ui/datepicker"
 )
 
 // handle all non-command messages
@@ -54,13 +55,15 @@ func messageHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 				break
 			}
 
-			sendButtonList(ctx, b, update, foundCities, fmt.Sprintf("Результаты для \"%s\":", msg), func(ctx context.Context, _ *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+			sendCardButtonList(ctx, b, update, foundCities, fmt.Sprintf("Результаты для \"%s\":", msg), func(ctx context.Context, _ *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
 				if err := updateLastForm(chatID, FormUpdate{DeparturePoint: strPtr(string(data))}); err != nil {
 					log.Print("Error: start:0 could not update last form", err)
 					return
 				}
-				sendMessage(ctx, b, update, "Выберите пункт назначения.")
-				updateSession(chatID, SessionUpdate{Step: intPtr(1)}) // next session step
+				nextStep(ctx, b, update, chatID, []string{"Откуда"}, func() {
+					sendCardPrompt(ctx, b, update, "Выберите пункт назначения.")
+					updateSession(chatID, SessionUpdate{Step: intPtr(1)}) // next session step
+				})
 			})
 		case 1: // line: user was asked where to
 
@@ -84,46 +87,21 @@ func messageHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 
 			foundCities = remove(foundCities, form.DeparturePoint)
 
-			sendButtonList(ctx, b, update, foundCities, fmt.Sprintf("Результаты для \"%s\":", msg), func(ctx context.Context, _ *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+			sendCardButtonList(ctx, b, update, foundCities, fmt.Sprintf("Результаты для \"%s\":", msg), func(ctx context.Context, _ *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
 				if err := updateLastForm(chatID, FormUpdate{ArrivalPoint: strPtr(string(data))}); err != nil {
 					log.Print("Error: start:1,0 could not update last form", err)
 					return
 				}
 
 				// sending DepartureDate
-				sendMessage(ctx, b, update, fmt.Sprintf("Маршрут выбран:\n%s -> %s", form.DeparturePoint, string(data)))
-				sendDatePicker(ctx, b, update, "Выберите дату отправления.", func(ctx context.Context, _ *bot.Bot, mes models.MaybeInaccessibleMessage, date time.Time) {
-					d := date.Format("2006-01-02")
-
-					if err := updateLastForm(chatID, FormUpdate{DepartureDate: &date}); err != nil {
-						log.Print("Error: start:1.1 could not update last form", err)
-						return
-					}
-
-					b.SendMessage(ctx, &bot.SendMessageParams{
-						ChatID: chatID,
-						Text:   "Вы выбрали:  " + d,
-					})
-
-					// sending CarriageType
-					sendButtonList(ctx, b, update, []string{"Любой", "Плацкарт", "Купе"}, "Какой тип вагона вас устроит?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
-						if err := updateLastForm(chatID, FormUpdate{CarriageType: strPtr(string(data))}); err != nil {
-							log.Print("Error: start:1.2 could not update last form", err)
-							return
-						}
-
-						sendMessage(ctx, b, update, "Сколько пассажиров?\n(Введите число от 1 до 6)")
-						updateSession(chatID, SessionUpdate{Step: intPtr(2)}) // next session step
-
-					})
-
+				nextStep(ctx, b, update, chatID, []string{"Куда"}, func() {
+					sendDepartureDateHandler(ctx, b, update, chatID)
 				})
-
 			})
 		case 2: // line: user replied with amount of passengers
 
 			numberOfPassengers, err := strconv.Atoi(msg)
-			if err != nil || !(numberOfPassengers >= 1 && numberOfPassengers <= 6) {
+			if err != nil || !isValidNumberOfPassengers(numberOfPassengers) {
 				sendMessage(ctx, b, update, "(Введите число от 1 до 6)")
 				return
 			}
@@ -134,78 +112,217 @@ func messageHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 			}
 
 			// sending CompartmentNumber
-			sendButtonList(ctx, b, update, []string{"Любой", "Не боковой", "Выбрать"}, "Какой отсек мест?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
-				compartmentNumber := []int{1, 2, 3, 4, 5, 6, 8, 9}
-				switch string(data) {
-				case "Любой":
-					compartmentNumber = []int{1, 2, 3, 4, 5, 6, 8, 9}
-				case "Не боковой":
-					compartmentNumber = []int{2, 3, 4, 5, 6, 8}
-				case "Выбрать":
-					sendMessage(ctx, b, update, "Перечислите отсек(и) через пробел (1-9)")
-					updateSession(chatID, SessionUpdate{Step: intPtr(3)}) // next session step
-					return
-				default:
-					log.Println("Error: unknown CompartmentNumber state")
-					return
-				}
-
-				if err := updateLastForm(chatID, FormUpdate{CompartmentNumber: &compartmentNumber}); err != nil {
-					log.Print("Error: start:2.0 could not update last form", err)
-					return
-				}
-
-				// sending ShelfType
-				sendShelfTypeHandler(ctx, b, update, chatID)
-
+			nextStep(ctx, b, update, chatID, []string{"Пассажиры"}, func() {
+				sendCompartmentNumberHandler(ctx, b, update, chatID)
 			})
 
 		case 3: // user chose CompartmentNumber
 
-			parsedCompartmentNumber, isValid := stringToCompartmentNumber(msg)
+			form, err := getLastForm(chatID)
+			if err != nil {
+				log.Print("Error: start:3 could not get last(current) form", err)
+				return
+			}
+
+			parsedCompartmentNumber, isValid := stringToCompartmentNumber(msg, maxCompartment(form.CarriageType))
 			if !isValid {
 				log.Println(parsedCompartmentNumber)
-				sendMessage(ctx, b, update, "Перечислите отсек(и) через пробел (1-9)")
+				sendMessage(ctx, b, update, fmt.Sprintf("Перечислите отсек(и) через пробел (1-%d)", maxCompartment(form.CarriageType)))
 				return
 			}
 
-			if err := updateLastForm(chatID, FormUpdate{CompartmentNumber: &parsedCompartmentNumber}); err != nil {
+			if err := updateLastForm(chatID, FormUpdate{CompartmentNumber: &parsedCompartmentNumber, NoSideShefl: new(bool)}); err != nil {
 				log.Print("Error: start:3.0 could not update last form", err)
 				return
 			}
 
 			// sending  ShelfType
-			sendShelfTypeHandler(ctx, b, update, chatID)
+			nextStep(ctx, b, update, chatID, []string{"Отсек"}, func() {
+				sendShelfTypeHandler(ctx, b, update, chatID)
+			})
 
-		case 4: // user sent number for bottom shelf
+		case 4: // user sent number of passengers for the shelf picked in ShelfType
 			form, err := getLastForm(chatID)
 			if err != nil {
 				log.Print("Error: start:4 could not get last(current) form", err)
 				return
 			}
 
-			numberOfPassengersBottomShefl, err := strconv.Atoi(msg)
-			if err != nil || !(numberOfPassengersBottomShefl >= 0 && numberOfPassengersBottomShefl <= 6) {
+			numberOfPassengersOnShelf, err := strconv.Atoi(msg)
+			if err != nil || !(numberOfPassengersOnShelf >= 0 && numberOfPassengersOnShelf <= form.NumberOfPassengers) {
 				sendMessage(ctx, b, update, fmt.Sprintf("(Введите число от 0 до %d)", form.NumberOfPassengers))
 				return
 			}
 
-			if err := updateLastForm(chatID, FormUpdate{NumberOfPassengersBottomShefl: &numberOfPassengersBottomShefl}); err != nil {
-				log.Print("Error: start:4.1 could not update last form", err)
+			bottom, top, rest := splitShelves(form, numberOfPassengersOnShelf)
+
+			// the rest may go to side shelves in plackart
+			if hasSideBerths(form.CarriageType) && !form.NoSideShefl && rest > 0 {
+				if err := updateLastForm(chatID, FormUpdate{NumberOfPassengersBottomShefl: &bottom, NumberOfPassengersTopShefl: &top}); err != nil {
+					log.Print("Error: start:4.1 could not update last form", err)
+					return
+				}
+
+				sendMessage(ctx, b, update, fmt.Sprintf("Сколько из остальных пассажиров (%d) на боковых полках?\n(Введите число от 0 до %d)", rest, rest))
+				updateSession(chatID, SessionUpdate{Step: intPtr(9)}) // next session step
 				return
 			}
 
-			if err := updateLastForm(chatID, FormUpdate{NumberOfPassengersTopShefl: intPtr(int(form.NumberOfPassengers - numberOfPassengersBottomShefl))}); err != nil {
-				log.Print("Error: start:4.2 could not update last form", err)
+			sendShelfAllocationHandler(ctx, b, update, chatID, bottom, top, 0)
+
+		case 6: // user sent round trip budget
+
+			roundTripBudget, err := strconv.Atoi(msg)
+			if err != nil || roundTripBudget < 0 {
+				sendMessage(ctx, b, update, "(Введите число, 0 — без бюджета)")
 				return
 			}
 
-			sendMessage(ctx, b, update, fmt.Sprintf("Нижние полки: %d\nВерхние полки: %d", numberOfPassengersBottomShefl, form.NumberOfPassengers-numberOfPassengersBottomShefl))
-			sendTrackPriceChangeHandler(ctx, b, update, chatID)
+			if err := updateLastForm(chatID, FormUpdate{RoundTripBudget: intPtr(roundTripBudget)}); err != nil {
+				log.Print("Error: start:6 could not update last form", err)
+				return
+			}
+
+			// sending CarriageType
+			nextStep(ctx, b, update, chatID, []string{"Дата"}, func() {
+				sendCarriageTypeHandler(ctx, b, update, chatID)
+			})
+
+		case 7: // user typed DepartureDate instead of using the datepicker
+
+			date, ok := parseNaturalDate(msg, time.Now().In(sessionLocation(session)))
+			if !ok {
+				sendMessage(ctx, b, update, "Не удалось распознать дату. Напишите, например, «20.11», «завтра» или «в пятницу», или выберите дату в календаре.")
+				return
+			}
+
+			sendCardButtonList(ctx, b, update, []string{"Да", "Нет"}, fmt.Sprintf("Дата отправления: %s. Верно?", formatDateWithWeekday(date)), func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+				if string(data) != "Да" {
+					sendDepartureDateHandler(ctx, b, update, chatID)
+					return
+				}
+				selectDepartureDate(ctx, b, update, chatID, date)
+			})
+
+		case 8: // user is expected to press a button
+
+			sendMessage(ctx, b, update, "Выберите вариант с помощью кнопок выше.")
+
+		case 9: // user sent number of passengers for side shelves
+			form, err := getLastForm(chatID)
+			if err != nil {
+				log.Print("Error: start:9 could not get last(current) form", err)
+				return
+			}
+
+			numberOfPassengersSideShefl, err := strconv.Atoi(msg)
+			if rest := shelfRest(form); err != nil || !(numberOfPassengersSideShefl >= 0 && numberOfPassengersSideShefl <= rest) {
+				sendMessage(ctx, b, update, fmt.Sprintf("(Введите число от 0 до %d)", rest))
+				return
+			}
+
+			bottom, top := moveToSideShelves(form, numberOfPassengersSideShefl)
+			sendShelfAllocationHandler(ctx, b, update, chatID, bottom, top, numberOfPassengersSideShefl)
+
+		case 10, 11: // user sent departure or arrival time window
+
+			window := TimeWindow{}
+			if msg != "-" {
+				var ok bool
+				if window, ok = parseTimeWindow(msg); !ok {
+					sendMessage(ctx, b, update, "(Введите интервал, например 18:00-23:00, или «-»)")
+					return
+				}
+			}
+
+			if session.Step == 10 {
+				if err := updateLastForm(chatID, FormUpdate{DepartureWindow: &window}); err != nil {
+					log.Print("Error: start:10 could not update last form", err)
+					return
+				}
+
+				sendMessage(ctx, b, update, "Время прибытия, например 06:00-12:00\n(или «-» — любое)")
+				updateSession(chatID, SessionUpdate{Step: intPtr(11)}) // next session step
+				return
+			}
+
+			if err := updateLastForm(chatID, FormUpdate{ArrivalWindow: &window}); err != nil {
+				log.Print("Error: start:11 could not update last form", err)
+				return
+			}
+
+			sendMessage(ctx, b, update, "Максимальное время в пути в часах\n(или «-» — любое)")
+			updateSession(chatID, SessionUpdate{Step: intPtr(12)}) // next session step
+
+		case 12: // user sent max trip duration
+
+			maxTripDuration := time.Duration(0)
+			if msg != "-" {
+				hours, err := strconv.Atoi(msg)
+				if err != nil || hours < 1 {
+					sendMessage(ctx, b, update, "(Введите число часов или «-»)")
+					return
+				}
+				maxTripDuration = time.Duration(hours) * time.Hour
+			}
+
+			if err := updateLastForm(chatID, FormUpdate{MaxTripDuration: &maxTripDuration}); err != nil {
+				log.Print("Error: start:12 could not update last form", err)
+				return
+			}
+
+			sendMessage(ctx, b, update, "Номера поездов через пробел, например 020У 016А\n(или «-» — любые)")
+			updateSession(chatID, SessionUpdate{Step: intPtr(13)}) // next session step
+
+		case 13: // user sent train numbers
+
+			trainNumbers := []string{}
+			if msg != "-" {
+				trainNumbers = parseTrainNumbers(msg)
+			}
+
+			if err := updateLastForm(chatID, FormUpdate{TrainNumbers: &trainNumbers}); err != nil {
+				log.Print("Error: start:13 could not update last form", err)
+				return
+			}
+
+			updateSession(chatID, SessionUpdate{Step: intPtr(8)}) // next session step
+			nextStep(ctx, b, update, chatID, []string{"Фильтры поездов"}, func() {
+				sendTrackPriceChangeHandler(ctx, b, update, chatID)
+			})
+
+		case 14: // user sent price ceiling
+
+			priceCeiling, err := strconv.Atoi(strings.ReplaceAll(msg, " ", ""))
+			if err != nil || priceCeiling < 1 {
+				sendMessage(ctx, b, update, "(Введите сумму в рублях, например 5000)")
+				return
+			}
+
+			if err := updateLastForm(chatID, FormUpdate{PriceCeiling: &priceCeiling}); err != nil {
+				log.Print("Error: start:14 could not update last form", err)
+				return
+			}
+
+			updateSession(chatID, SessionUpdate{Step: intPtr(8)}) // next session step
+			sendSuggestSimilarSeatsHandler(ctx, b, update, chatID)
+
+		case 15: // user sent price change threshold
 
-		case 5: // TODO
+			changeThreshold, err := strconv.Atoi(strings.TrimSuffix(strings.ReplaceAll(msg, " ", ""), "%"))
+			if err != nil || changeThreshold < 1 {
+				sendMessage(ctx, b, update, "(Введите целое число больше 0)")
+				return
+			}
+
+			if err := updateLastForm(chatID, FormUpdate{ChangeThreshold: &changeThreshold}); err != nil {
+				log.Print("Error: start:15 could not update last form", err)
+				return
+			}
+
+			updateSession(chatID, SessionUpdate{Step: intPtr(8)}) // next session step
+			sendChangeDirectionHandler(ctx, b, update, chatID)
 
-			updateSession(chatID, SessionUpdate{Command: strPtr("none"), Step: intPtr(0)}) // next session step
 		default:
 			log.Println("Error: unknown session step state")
 			return
@@ -216,180 +333,1056 @@ func messageHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	}
 }
 
-func sendShelfTypeHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64) {
-	sendButtonList(ctx, b, update, []string{"Любое", "Указать нижние", "Указать верхние"}, "Какое размещение вас устроит?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
-		if err := updateLastForm(chatID, FormUpdate{ShelfType: strPtr(string(data))}); err != nil {
-			log.Print("Error: start:sendShelfTypeHandler could not update last form", err)
+func sendDepartureDateHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64) {
+	updateSession(chatID, SessionUpdate{Step: intPtr(7)}) // next session step
+	sendCardDatePicker(ctx, b, update, "Выберите дату отправления или напишите её, например «20.11», «завтра» или «в пятницу».", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, date time.Time) {
+		selectDepartureDate(ctx, b, update, chatID, date)
+	}, func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage) {
+		session, err := getSession(chatID)
+		if err != nil {
+			log.Println("Error: start:sendDepartureDateHandler could not get session: ", err)
 			return
 		}
 
-		form, err := getLastForm(chatID)
-		if err != nil {
-			log.Print("Error: start:sendShelfTypeHandler could not get last(current) form", err)
+		// the date is already chosen the other way
+		if session.Command != "start" || session.Step != 7 {
 			return
 		}
 
-		if string(data) != "Любое" {
-			sendMessage(ctx, b, update, fmt.Sprintf("Укажите количество пассажиров для нижней полки:\n(Введите число от 0 до %d)", form.NumberOfPassengers))
-			updateSession(chatID, SessionUpdate{Step: intPtr(4)}) // next session step
+		// back to the list of fields when only the date is changed
+		if session.EditingField != "" {
+			updateSession(chatID, SessionUpdate{Step: intPtr(8)}) // next session step
+			sendEditFieldHandler(ctx, b, update, chatID)
 			return
 		}
+		sendCardPrompt(ctx, b, update, "Выберите пункт назначения.")
+		updateSession(chatID, SessionUpdate{Step: intPtr(1)}) // next session step
+	})
+}
+
+// selectDepartureDate continues the wizard once DepartureDate is picked in the datepicker or typed and confirmed
+func selectDepartureDate(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, date time.Time) {
+	session, err := getSession(chatID)
+	if err != nil {
+		log.Println("Error: start:selectDepartureDate could not get session: ", err)
+		return
+	}
 
-		sendTrackPriceChangeHandler(ctx, b, update, chatID)
+	// the date is already chosen the other way
+	if session.Command != "start" || session.Step != 7 {
+		return
+	}
 
-	})
+	date = calendarDay(date)
+	if err := updateLastForm(chatID, FormUpdate{DepartureDate: &date}); err != nil {
+		log.Print("Error: start:selectDepartureDate could not update last form", err)
+		return
+	}
+	updateSession(chatID, SessionUpdate{Step: intPtr(8)}) // next session step
+
+	// sending DepartureDateTo
+	sendDateRangeHandler(ctx, b, update, chatID, date)
 }
 
-func sendTrackPriceChangeHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64) {
-	sendButtonList(ctx, b, update, []string{"Да", "Нет"}, "Отслеживать изменение цены?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
-		trackPriceChange := false
-		if string(data) == "Да" {
-			trackPriceChange = true
-		}
+func sendDateRangeHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, departureDate time.Time) {
+	sendCardButtonList(ctx, b, update, []string{"Только эта дата", "Диапазон дат"}, "Отслеживать несколько дат отправления?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+		if string(data) != "Диапазон дат" {
+			if err := updateLastForm(chatID, FormUpdate{DepartureDateTo: &time.Time{}}); err != nil {
+				log.Print("Error: start:sendDateRangeHandler could not update last form", err)
+				return
+			}
 
-		if err := updateLastForm(chatID, FormUpdate{TrackPriceChange: &trackPriceChange}); err != nil {
-			log.Print("Error: start:trackPriceChange could not update last form", err)
+			// sending RoundTrip
+			sendTripTypeHandler(ctx, b, update, chatID, departureDate)
 			return
 		}
 
-		sendSuggestSimilarSeatsHandler(ctx, b, update, chatID)
+		sendCardDatePicker(ctx, b, update, "Выберите последнюю дату отправления (не позже 2 недель).", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, date time.Time) {
+			date = calendarDay(date)
+			if err := updateLastForm(chatID, FormUpdate{DepartureDateTo: &date}); err != nil {
+				log.Print("Error: start:sendDateRangeHandler could not update last form", err)
+				return
+			}
+
+			// sending RoundTrip
+			sendTripTypeHandler(ctx, b, update, chatID, date)
+		}, func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage) {
+			sendDateRangeHandler(ctx, b, update, chatID, departureDate)
+		}, datepicker.From(pickerDay(departureDate)), datepicker.To(pickerDay(departureDate.AddDate(0, 0, 13))))
 	})
 }
 
-func sendSuggestSimilarSeatsHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64) {
-	sendButtonList(ctx, b, update, []string{"Да", "Нет"}, "Предлагать похожие места?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
-		suggestSimilarSeats := false
-		if string(data) == "Да" {
-			suggestSimilarSeats = true
-		}
+func sendTripTypeHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, departureDate time.Time) {
+	sendCardButtonList(ctx, b, update, []string{"В одну сторону", "Туда-обратно"}, "Какая поездка?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+		roundTrip := string(data) == "Туда-обратно"
 
-		if err := updateLastForm(chatID, FormUpdate{SuggestSimilarSeats: &suggestSimilarSeats}); err != nil {
-			log.Print("Error: start:suggestSimilarSeats could not update last form", err)
+		if err := updateLastForm(chatID, FormUpdate{RoundTrip: &roundTrip}); err != nil {
+			log.Print("Error: start:sendTripTypeHandler could not update last form", err)
 			return
 		}
 
-		form, err := getLastForm(chatID)
-		if err != nil {
-			log.Print("Error: start:suggestSimilarSeats could not get last(current) form", err)
+		if !roundTrip {
+			nextStep(ctx, b, update, chatID, []string{"Дата"}, func() {
+				sendCarriageTypeHandler(ctx, b, update, chatID)
+			})
 			return
 		}
 
-		sendFormSaved(ctx, b, update)
-		updateSession(chatID, SessionUpdate{Command: strPtr("none"), Step: intPtr(0)}) // next session step
-		startMonitoring(ctx, b, update, chatID, form)
+		// sending ReturnDate
+		sendCardDatePicker(ctx, b, update, "Выберите дату обратного отправления.", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, date time.Time) {
+			date = calendarDay(date)
+			if err := updateLastForm(chatID, FormUpdate{ReturnDate: &date}); err != nil {
+				log.Print("Error: start:sendTripTypeHandler could not update last form", err)
+				return
+			}
+
+			sendCardPrompt(ctx, b, update, "Общий бюджет на обе поездки для всех пассажиров в рублях?\n(Введите число, 0 — без бюджета)")
+			updateSession(chatID, SessionUpdate{Step: intPtr(6)}) // next session step
+		}, func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage) {
+			sendTripTypeHandler(ctx, b, update, chatID, departureDate)
+		}, datepicker.From(pickerDay(departureDate)))
 	})
 }
 
-// when user typed `/start`
-func startHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
-	chatID := update.Message.Chat.ID
+func sendCarriageTypeHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64) {
+	sendCardEnumButtonList(ctx, b, update, carriageTypes, CarriageType.Label, "Какой тип вагона вас устроит?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+		carriageType := CarriageType(data)
+		if err := updateLastForm(chatID, FormUpdate{CarriageType: &carriageType}); err != nil {
+			log.Print("Error: start:sendCarriageTypeHandler could not update last form", err)
+			return
+		}
 
-	hasSession, err := userHasSession(chatID)
+		// compartments and shelves depend on the carriage type, so a changed type goes on to them
+		sendCardPrompt(ctx, b, update, "Сколько пассажиров?\n(Введите число от 1 до 6)")
+		updateSession(chatID, SessionUpdate{Step: intPtr(2)}) // next session step
+	})
+}
+
+func sendCompartmentNumberHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64) {
+	form, err := getLastForm(chatID)
 	if err != nil {
-		log.Print("Error: could not check if user has session: ", err)
+		log.Print("Error: start:sendCompartmentNumberHandler could not get last(current) form", err)
 		return
 	}
 
-	if !hasSession {
-		if err := createSession(chatID); err != nil {
-			log.Print("Error: could not create new session: ", err)
+	// no compartments in sitting cars
+	if !hasCompartments(form.CarriageType) {
+		compartmentNumber := allCompartments(form.CarriageType)
+		if err := updateLastForm(chatID, FormUpdate{CompartmentNumber: &compartmentNumber, NoSideShefl: new(bool)}); err != nil {
+			log.Print("Error: start:sendCompartmentNumberHandler could not update last form", err)
 			return
 		}
-	}
 
-	session, err := getSession(chatID)
-	if err != nil {
-		log.Println("Error: could not get session: ", err)
+		nextStep(ctx, b, update, chatID, []string{"Отсек"}, func() {
+			sendShelfTypeHandler(ctx, b, update, chatID)
+		})
 		return
 	}
 
-	if session.Command != "none" {
-		sendResposeIsInvalid(ctx, b, update)
-	} else {
-		updateSession(chatID, SessionUpdate{Command: strPtr("start"), Step: intPtr(0)})
-		insertEmptyForm(chatID)
-
-		sendMessage(ctx, b, update, "Откуда вы хотите отправиться?")
+	presets := compartmentPresets
+	if !hasSideBerths(form.CarriageType) {
+		presets = remove(presets, CompartmentNotSide)
 	}
-}
 
-// when user typed `/list`
-func listHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
-	chatID := update.Message.Chat.ID
+	sendCardEnumButtonList(ctx, b, update, presets, CompartmentPreset.Label, "Какой отсек мест?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+		compartmentNumber := allCompartments(form.CarriageType)
+		noSideShefl := false
+		switch CompartmentPreset(data) {
+		case CompartmentAny:
+		case CompartmentNotSide:
+			noSideShefl = true
+		case CompartmentCustom:
+			sendCardPrompt(ctx, b, update, fmt.Sprintf("Перечислите отсек(и) через пробел (1-%d)", maxCompartment(form.CarriageType)))
+			updateSession(chatID, SessionUpdate{Step: intPtr(3)}) // next session step
+			return
+		default:
+			log.Println("Error: unknown CompartmentNumber state")
+			return
+		}
 
-	hasSession, err := userHasSession(chatID)
+		if err := updateLastForm(chatID, FormUpdate{CompartmentNumber: &compartmentNumber, NoSideShefl: &noSideShefl}); err != nil {
+			log.Print("Error: start:sendCompartmentNumberHandler could not update last form", err)
+			return
+		}
+
+		// sending ShelfType
+		nextStep(ctx, b, update, chatID, []string{"Отсек"}, func() {
+			sendShelfTypeHandler(ctx, b, update, chatID)
+		})
+
+	})
+}
+
+func sendShelfTypeHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64) {
+	form, err := getLastForm(chatID)
 	if err != nil {
-		log.Print("Error: could not check if user has session: ", err)
+		log.Print("Error: start:sendShelfTypeHandler could not get last(current) form", err)
 		return
 	}
 
-	if !hasSession {
-		sendNoForms(ctx, b, update)
-		return
-	}
+	// all berths are lower in SV and lux, there are no berths in sitting cars
+	if !hasUpperBerths(form.CarriageType) {
+		shelfType := ShelfAny
+		if err := updateLastForm(chatID, FormUpdate{ShelfType: &shelfType, NumberOfPassengersBottomShefl: intPtr(0), NumberOfPassengersTopShefl: intPtr(0), NumberOfPassengersSideShefl: intPtr(0)}); err != nil {
+			log.Print("Error: start:sendShelfTypeHandler could not update last form", err)
+			return
+		}
 
-	session, err := getSession(chatID)
-	if err != nil {
-		log.Println("Error: could not get session: ", err)
+		nextStep(ctx, b, update, chatID, []string{"Тип вагона", "Пассажиры", "Отсек", "Полки"}, func() {
+			sendTrainFiltersHandler(ctx, b, update, chatID)
+		})
 		return
 	}
 
-	if session.Command != "none" {
-		sendResposeIsInvalid(ctx, b, update)
-	} else {
+	sendCardEnumButtonList(ctx, b, update, shelfTypes, ShelfType.Label, "Какое размещение вас устроит?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+		shelfType := ShelfType(data)
+		if err := updateLastForm(chatID, FormUpdate{ShelfType: &shelfType}); err != nil {
+			log.Print("Error: start:sendShelfTypeHandler could not update last form", err)
+			return
+		}
 
-		sendMessage(ctx, b, update, "Список всех отслеживаемых форм:")
-		for _, form := range session.Forms {
-			seats := ""
-			if form.ShelfType == "Любое" {
-				seats = "Любые места"
-			} else {
-				seats = fmt.Sprintf("Нижних полок: %d\nВерхних полок: %d", form.NumberOfPassengersBottomShefl, form.NumberOfPassengersTopShefl)
-			}
-			formOptions := []string{}
-			if form.TrackPriceChange {
-				formOptions = append(formOptions, "Отслеживать цену")
-			}
-			if form.SuggestSimilarSeats {
-				formOptions = append(formOptions, "Предлагать похожие места")
-			} else {
-				formOptions = append(formOptions, "Только выбранные места")
-			}
+		switch shelfType {
+		case ShelfBottom:
+			sendCardPrompt(ctx, b, update, fmt.Sprintf("Сколько пассажиров на нижних полках?\n(Введите число от 0 до %d)", form.NumberOfPassengers))
+			updateSession(chatID, SessionUpdate{Step: intPtr(4)}) // next session step
+			return
+		case ShelfTop:
+			sendCardPrompt(ctx, b, update, fmt.Sprintf("Сколько пассажиров на верхних полках?\n(Введите число от 0 до %d)", form.NumberOfPassengers))
+			updateSession(chatID, SessionUpdate{Step: intPtr(4)}) // next session step
+			return
+		}
 
-			sendMessage(ctx, b, update, fmt.Sprintf("Отслеживаемый маршрут: \n%s → %s\nДата: %s\nТип Вагона: %s\nКоличество Пассажиров: %d\nОтсек: %s\n%s\n%s\nНомер формы: %d", form.DeparturePoint, form.ArrivalPoint, fmt.Sprintf("%d %d %d", form.DepartureDate.Day(), form.DepartureDate.Month(), form.DepartureDate.Year()), form.CarriageType, form.NumberOfPassengers, compartmentNumberToString(form.CompartmentNumber), seats, strings.Join(formOptions, ",\n"), form.ID))
+		if err := updateLastForm(chatID, FormUpdate{NumberOfPassengersBottomShefl: intPtr(0), NumberOfPassengersTopShefl: intPtr(0), NumberOfPassengersSideShefl: intPtr(0)}); err != nil {
+			log.Print("Error: start:sendShelfTypeHandler could not update last form", err)
+			return
 		}
-	}
-}
 
-// when user typed `/status`
-func statusHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
-	chatID := update.Message.Chat.ID
+		nextStep(ctx, b, update, chatID, []string{"Тип вагона", "Пассажиры", "Отсек", "Полки"}, func() {
+			sendTrainFiltersHandler(ctx, b, update, chatID)
+		})
+	})
+}
 
-	hasSession, err := userHasSession(chatID)
-	if err != nil {
-		log.Print("Error: could not check if user has session: ", err)
+// saves the shelf allocation, bottom + top + side must equal NumberOfPassengers
+func sendShelfAllocationHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, bottom, top, side int) {
+	if err := updateLastForm(chatID, FormUpdate{NumberOfPassengersBottomShefl: &bottom, NumberOfPassengersTopShefl: &top, NumberOfPassengersSideShefl: &side}); err != nil {
+		log.Print("Error: start:sendShelfAllocationHandler could not update last form", err)
 		return
 	}
 
-	if !hasSession {
-		sendNoForms(ctx, b, update)
-		return
-	}
+	updateSession(chatID, SessionUpdate{Step: intPtr(8)}) // next session step
+	nextStep(ctx, b, update, chatID, []string{"Тип вагона", "Пассажиры", "Отсек", "Полки"}, func() {
+		sendTrainFiltersHandler(ctx, b, update, chatID)
+	})
+}
 
-	session, err := getSession(chatID)
-	if err != nil {
-		log.Println("Error: could not get session: ", err)
-		return
-	}
+// optional filters on the trains of the date, each step accepts "-" for no filter
+func sendTrainFiltersHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64) {
+	updateSession(chatID, SessionUpdate{Step: intPtr(8)}) // next session step
+	sendCardButtonList(ctx, b, update, []string{"Любые поезда", "Настроить фильтры"}, "Какие поезда отслеживать?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+		if string(data) != "Настроить фильтры" {
+			noFilters := FormUpdate{DepartureWindow: &TimeWindow{}, ArrivalWindow: &TimeWindow{}, MaxTripDuration: new(time.Duration), TrainNumbers: &[]string{}}
+			if err := updateLastForm(chatID, noFilters); err != nil {
+				log.Print("Error: start:sendTrainFiltersHandler could not update last form", err)
+				return
+			}
 
-	if session.Command != "none" {
-		sendResposeIsInvalid(ctx, b, update)
-	} else {
+			nextStep(ctx, b, update, chatID, []string{"Фильтры поездов"}, func() {
+				sendTrackPriceChangeHandler(ctx, b, update, chatID)
+			})
+			return
+		}
 
-		// sendMessage(ctx, b, update, "Список всех отслеживаемых форм:")
-		for _, formStatus := range session.FormsStatus {
+		sendCardPrompt(ctx, b, update, "Время отправления, например 18:00-23:00\n(или «-» — любое)")
+		updateSession(chatID, SessionUpdate{Step: intPtr(10)}) // next session step
+	})
+}
+
+func sendTrackPriceChangeHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64) {
+	sendCardButtonList(ctx, b, update, []string{"Да", "Нет"}, "Отслеживать изменение цены?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+		trackPriceChange := false
+		if string(data) == "Да" {
+			trackPriceChange = true
+		}
 
-			sendMessage(ctx, b, update, fmt.Sprintf("Билеты на %s: \nПлацкарт: %s", formStatus.Date.Format("02 01 2006"), formStatus.Price))
+		if err := updateLastForm(chatID, FormUpdate{TrackPriceChange: &trackPriceChange}); err != nil {
+			log.Print("Error: start:trackPriceChange could not update last form", err)
+			return
+		}
+
+		if !trackPriceChange {
+			if err := updateLastForm(chatID, FormUpdate{ChangeThreshold: intPtr(0), ChangeThresholdPercent: new(bool), ChangeDirection: new(ChangeDirection)}); err != nil {
+				log.Print("Error: start:trackPriceChange could not update last form", err)
+				return
+			}
+
+			sendPriceCeilingHandler(ctx, b, update, chatID)
+			return
+		}
+
+		sendChangeThresholdHandler(ctx, b, update, chatID)
+	})
+}
+
+func sendChangeThresholdHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64) {
+	sendCardButtonList(ctx, b, update, []string{"Любое изменение", "В процентах", "В рублях"}, "О каком изменении цены сообщать?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+		if string(data) == "Любое изменение" {
+			if err := updateLastForm(chatID, FormUpdate{ChangeThreshold: intPtr(0), ChangeThresholdPercent: new(bool)}); err != nil {
+				log.Print("Error: start:changeThreshold could not update last form", err)
+				return
+			}
+
+			sendChangeDirectionHandler(ctx, b, update, chatID)
+			return
+		}
+
+		percent := string(data) == "В процентах"
+		if err := updateLastForm(chatID, FormUpdate{ChangeThresholdPercent: &percent}); err != nil {
+			log.Print("Error: start:changeThreshold could not update last form", err)
+			return
+		}
+
+		if percent {
+			sendCardPrompt(ctx, b, update, "Минимальное изменение цены в процентах?")
+		} else {
+			sendCardPrompt(ctx, b, update, "Минимальное изменение цены в рублях?")
+		}
+		updateSession(chatID, SessionUpdate{Step: intPtr(15)}) // next session step
+	})
+}
+
+func sendChangeDirectionHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64) {
+	sendCardEnumButtonList(ctx, b, update, changeDirections, ChangeDirection.Label, "Какие изменения цены отслеживать?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+		changeDirection := ChangeDirection(data)
+		if err := updateLastForm(chatID, FormUpdate{ChangeDirection: &changeDirection}); err != nil {
+			log.Print("Error: start:changeDirection could not update last form", err)
+			return
+		}
+
+		sendPriceCeilingHandler(ctx, b, update, chatID)
+	})
+}
+
+func sendPriceCeilingHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64) {
+	sendCardButtonList(ctx, b, update, []string{"Без ограничения", "За всех пассажиров", "За одного пассажира"}, "Максимальная цена?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+		if string(data) == "Без ограничения" {
+			if err := updateLastForm(chatID, FormUpdate{PriceCeiling: intPtr(0), PriceCeilingPerPassenger: new(bool)}); err != nil {
+				log.Print("Error: start:priceCeiling could not update last form", err)
+				return
+			}
+
+			sendSuggestSimilarSeatsHandler(ctx, b, update, chatID)
+			return
+		}
+
+		perPassenger := string(data) == "За одного пассажира"
+		if err := updateLastForm(chatID, FormUpdate{PriceCeilingPerPassenger: &perPassenger}); err != nil {
+			log.Print("Error: start:priceCeiling could not update last form", err)
+			return
+		}
+
+		sendCardPrompt(ctx, b, update, "Введите максимальную цену в рублях.")
+		updateSession(chatID, SessionUpdate{Step: intPtr(14)}) // next session step
+	})
+}
+
+func sendSuggestSimilarSeatsHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64) {
+	sendCardButtonList(ctx, b, update, []string{"Да", "Нет"}, "Предлагать похожие места?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+		suggestSimilarSeats := false
+		if string(data) == "Да" {
+			suggestSimilarSeats = true
+		}
+
+		if err := updateLastForm(chatID, FormUpdate{SuggestSimilarSeats: &suggestSimilarSeats}); err != nil {
+			log.Print("Error: start:suggestSimilarSeats could not update last form", err)
+			return
+		}
+
+		form, err := getLastForm(chatID)
+		if err != nil {
+			log.Print("Error: start:suggestSimilarSeats could not get last(current) form", err)
+			return
+		}
+
+		sendFormSummaryHandler(ctx, b, update, chatID, form)
+	})
+}
+
+// shows the filled form and saves it only after explicit confirmation
+func sendFormSummaryHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, form Form) {
+	updateSession(chatID, SessionUpdate{Step: intPtr(8), EditingField: strPtr("")}) // next session step
+	sendCardButtonList(ctx, b, update, []string{"Сохранить", "Изменить поле", "Отмена"}, "Всё верно?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+		session, err := getSession(chatID)
+		if err != nil {
+			log.Println("Error: start:summary could not get session: ", err)
+			return
+		}
+
+		// the form is already saved or cancelled
+		if session.Command != "start" {
+			return
+		}
+
+		switch string(data) {
+		case "Сохранить":
+			form, err := getLastForm(chatID)
+			if err != nil {
+				log.Print("Error: start:summary could not get last(current) form", err)
+				return
+			}
+
+			text := "✅ Запрос сохранён! Я уведомлю вас, как только появятся билеты, соответствующие вашим параметрам.\n\nДля просмотра списка отслеживаемых билетов используйте /list."
+
+			// an edited form takes the place and the ID of the original
+			if session.Editing {
+				stopMonitoring(chatID, session.EditingFormID)
+				form, err = replaceFormWithLast(chatID, session.EditingFormID)
+				if err != nil {
+					log.Print("Error: start:summary could not replace edited form", err)
+					return
+				}
+				text = fmt.Sprintf("✅ Форма %d изменена.", form.ID)
+			}
+
+			closeCard(ctx, b, chatID, form, text)
+			updateSession(chatID, SessionUpdate{Command: strPtr("none"), Step: intPtr(0), Editing: new(bool)}) // next session step
+			if !form.Paused {
+				startMonitoring(ctx, b, update, chatID, form)
+			}
+		case "Изменить поле":
+			sendEditFieldHandler(ctx, b, update, chatID)
+		case "Отмена":
+			form, err := getLastForm(chatID)
+			if err != nil {
+				log.Print("Error: start:summary could not get last(current) form", err)
+				return
+			}
+			if err := removeLastForm(chatID); err != nil {
+				log.Print("Error: start:summary could not remove last form", err)
+				return
+			}
+
+			closeCard(ctx, b, chatID, form, "❌ Запрос отменён.")
+			updateSession(chatID, SessionUpdate{Command: strPtr("none"), Step: intPtr(0), Editing: new(bool)}) // next session step
+		}
+	})
+}
+
+// resumes the wizard from the chosen field, the next steps lead back to the summary
+func sendEditFieldHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64) {
+	sendCardButtonList(ctx, b, update, []string{"Откуда", "Куда", "Дата", "Тип вагона", "Пассажиры", "Отсек", "Полки", "Фильтры поездов", "Отслеживание цены"}, "Какое поле изменить?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+		updateSession(chatID, SessionUpdate{EditingField: strPtr(string(data))})
+
+		switch string(data) {
+		case "Откуда":
+			sendCardPrompt(ctx, b, update, "Откуда вы хотите отправиться?")
+			updateSession(chatID, SessionUpdate{Step: intPtr(0)}) // next session step
+		case "Куда":
+			sendCardPrompt(ctx, b, update, "Выберите пункт назначения.")
+			updateSession(chatID, SessionUpdate{Step: intPtr(1)}) // next session step
+		case "Дата":
+			sendDepartureDateHandler(ctx, b, update, chatID)
+		case "Тип вагона":
+			sendCarriageTypeHandler(ctx, b, update, chatID)
+		case "Пассажиры":
+			sendCardPrompt(ctx, b, update, "Сколько пассажиров?\n(Введите число от 1 до 6)")
+			updateSession(chatID, SessionUpdate{Step: intPtr(2)}) // next session step
+		case "Отсек":
+			sendCompartmentNumberHandler(ctx, b, update, chatID)
+		case "Полки":
+			sendShelfTypeHandler(ctx, b, update, chatID)
+		case "Фильтры поездов":
+			sendTrainFiltersHandler(ctx, b, update, chatID)
+		case "Отслеживание цены":
+			sendTrackPriceChangeHandler(ctx, b, update, chatID)
+		}
+	})
+}
+
+// nextStep goes on with next, or back to the summary when the field being changed is one of done
+// and the form is complete again
+func nextStep(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, done []string, next func()) {
+	session, err := getSession(chatID)
+	if err != nil {
+		log.Println("Error: start:nextStep could not get session: ", err)
+		return
+	}
+	if !contains(done, session.EditingField) {
+		next()
+		return
+	}
+
+	form, err := getLastForm(chatID)
+	if err != nil {
+		log.Print("Error: start:nextStep could not get last(current) form", err)
+		return
+	}
+	// e.g. fewer passengers than the shelves were allocated for, the rest of the wizard fixes it
+	if form.Validate() != nil {
+		next()
+		return
+	}
+
+	sendFormSummaryHandler(ctx, b, update, chatID, form)
+}
+
+// when user pressed "Дублировать" on a `/list` entry
+func duplicateFormHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, form Form) {
+	sendButtonList(ctx, b, update, []string{"Другая дата", "Обратный путь"}, fmt.Sprintf("Дублировать форму %d:\n%s → %s", form.ID, form.DeparturePoint, form.ArrivalPoint), func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+		// the copy is a new form: it is monitored even if the original was paused or inactive
+		clone := cloneForm(form)
+		clone.Paused, clone.Inactive = false, false
+		if string(data) == "Обратный путь" {
+			clone.DeparturePoint, clone.ArrivalPoint = form.ArrivalPoint, form.DeparturePoint
+		}
+
+		session, err := getSession(chatID)
+		if err != nil {
+			log.Println("Error: duplicate could not get session: ", err)
+			return
+		}
+		today := calendarDay(time.Now().In(sessionLocation(session)))
+
+		sendDatePicker(ctx, b, update, fmt.Sprintf("Маршрут: %s → %s\nВыберите дату отправления.", clone.DeparturePoint, clone.ArrivalPoint), func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, date time.Time) {
+			session, err := getSession(chatID)
+			if err != nil {
+				log.Println("Error: duplicate could not get session: ", err)
+				return
+			}
+
+			// the last form is incomplete while the wizard is running
+			if session.Command != "none" {
+				sendResposeIsInvalid(ctx, b, update)
+				return
+			}
+
+			date = calendarDay(date)
+			if date.Before(today) {
+				sendMessage(ctx, b, update, "Эта дата уже прошла, выберите другую.")
+				return
+			}
+			if clone.RoundTrip {
+				clone.ReturnDate = date.Add(form.ReturnDate.Sub(form.DepartureDate))
+			}
+			if !clone.DepartureDateTo.IsZero() {
+				clone.DepartureDateTo = date.Add(form.DepartureDateTo.Sub(form.DepartureDate))
+			}
+			clone.DepartureDate = date
+			clone.ID, err = insertForm(chatID, clone)
+			if err != nil {
+				log.Println("Error: duplicate could not insert form: ", err)
+				return
+			}
+
+			sendFormSaved(ctx, b, update)
+			startMonitoring(ctx, b, update, chatID, clone)
+		}, datepicker.From(pickerDay(today)))
+	})
+}
+
+// stops monitoring the form until it is resumed
+func pauseFormHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, form Form) {
+	if err := setFormPaused(chatID, form.ID, true); err != nil {
+		log.Println("Error: could not pause form: ", err)
+		return
+	}
+	stopMonitoring(chatID, form.ID)
+
+	// the button goes through formActionHandler, which resumes the form as it is when pressed
+	if err := sendLimiter.Wait(ctx, chatID); err != nil {
+		return
+	}
+	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID: chatID,
+		Text:   fmt.Sprintf("Форма %d на паузе.", form.ID),
+		ReplyMarkup: models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+			{{Text: "Продолжить", CallbackData: formActionData(formActionResume, form.ID)}},
+		}},
+	})
+	if err != nil {
+		log.Printf("Error: could not send message to chat %d: %v", chatID, err)
+	}
+}
+
+// starts monitoring the paused form again
+func resumeFormHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, form Form) {
+	if err := setFormPaused(chatID, form.ID, false); err != nil {
+		log.Println("Error: could not resume form: ", err)
+		return
+	}
+	form.Paused = false
+
+	sendMessage(ctx, b, update, fmt.Sprintf("Форма %d снова отслеживается.", form.ID))
+	startMonitoring(ctx, b, update, chatID, form)
+}
+
+// when user pressed "📊" on a `/list` entry: the latest prices of the form
+func formStatusHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, form Form) {
+	loc := time.Local
+	if session, err := getSession(chatID); err == nil {
+		loc = sessionLocation(session)
+	}
+
+	text := fmt.Sprintf("Форма %d: %s → %s, %s", form.ID, form.DeparturePoint, form.ArrivalPoint, formDatesString(form))
+	history, err := getFormHistory(chatID, form.ID)
+	if err != nil || len(history) == 0 {
+		text += "\nЦены ещё не проверялись."
+	} else {
+		entry := history[len(history)-1]
+		for _, classPrice := range entry.ClassPrices {
+			text += fmt.Sprintf("\n%s: %s", classPrice.Class.Label(), classPrice.Price)
+			if classPrice.Seats > 0 {
+				text += fmt.Sprintf(", свободных мест: %d", classPrice.Seats)
+			}
+		}
+		if len(entry.ClassPrices) == 0 {
+			text += fmt.Sprintf("\nЦена: %s", entry.Price)
+		}
+		if !form.DepartureDateTo.IsZero() {
+			text += fmt.Sprintf("\nЛучшая цена за период: %s", entry.BestPrice)
+		}
+		if form.RoundTrip {
+			text += fmt.Sprintf("\nОбратно %s: %s", formatDateWithWeekday(form.ReturnDate), entry.ReturnPrice)
+		}
+		text += "\nЦена изменилась: " + entry.Time.In(loc).Format("02.01 15:04")
+	}
+	if check, ok := lastCheck(chatID, form.ID); ok {
+		text += "\nПоследняя проверка: " + check.Checked.In(loc).Format("02.01 15:04")
+	}
+	if form.Paused {
+		text += "\nНа паузе"
+	}
+	sendMessage(ctx, b, update, text)
+}
+
+// when user pressed "✏️" on a `/list` entry: the wizard works on a copy, which replaces the form on save
+func editFormHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, form Form) {
+	session, err := getSession(chatID)
+	if err != nil {
+		log.Println("Error: edit could not get session: ", err)
+		return
+	}
+
+	// the last form is incomplete while the wizard is running
+	if session.Command != "none" {
+		sendResposeIsInvalid(ctx, b, update)
+		return
+	}
+
+	if _, err := insertForm(chatID, cloneForm(form)); err != nil {
+		log.Println("Error: edit could not insert form: ", err)
+		return
+	}
+	editing := true
+	updateSession(chatID, SessionUpdate{Command: strPtr("start"), Step: intPtr(8), CardMessageID: intPtr(0), Editing: &editing, EditingFormID: &form.ID, EditingField: strPtr("")})
+
+	sendEditFieldHandler(ctx, b, update, chatID)
+}
+
+// when user pressed "🗑" on a `/list` entry, onDeleted runs once the form is gone
+func deleteFormHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, form Form, onDeleted func(ctx context.Context)) {
+	sendButtonList(ctx, b, update, []string{"Удалить", "Оставить"}, fmt.Sprintf("Удалить форму %d (%s → %s, %s)?", form.ID, form.DeparturePoint, form.ArrivalPoint, formDatesString(form)), func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+		if string(data) != "Удалить" {
+			return
+		}
+
+		session, err := getSession(chatID)
+		if err != nil {
+			log.Println("Error: delete could not get session: ", err)
+			return
+		}
+
+		// the form may be open in the wizard
+		if session.Command != "none" {
+			sendResposeIsInvalid(ctx, b, update)
+			return
+		}
+
+		stopMonitoring(chatID, form.ID)
+		if err := removeForm(chatID, form.ID); err != nil {
+			log.Println("Error: could not delete form: ", err)
+			return
+		}
+
+		sendMessage(ctx, b, update, fmt.Sprintf("Форма %d удалена.", form.ID))
+		onDeleted(ctx)
+	})
+}
+
+// shows the recorded states of the form, latest last
+func historyHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, form Form) {
+	history, err := getFormHistory(chatID, form.ID)
+	if err != nil {
+		log.Println("Error: could not get form history: ", err)
+		return
+	}
+
+	if len(history) == 0 {
+		sendMessage(ctx, b, update, fmt.Sprintf("История формы %d пуста.", form.ID))
+		return
+	}
+
+	loc := time.Local
+	if session, err := getSession(chatID); err == nil {
+		loc = sessionLocation(session)
+	}
+
+	text := fmt.Sprintf("История формы %d: %s → %s", form.ID, form.DeparturePoint, form.ArrivalPoint)
+	for _, entry := range history {
+		text += fmt.Sprintf("\n%s — %s", entry.Time.In(loc).Format("02.01 15:04"), entry.Price)
+		if form.RoundTrip {
+			text += fmt.Sprintf(", обратно %s", entry.ReturnPrice)
+		}
+	}
+	sendMessage(ctx, b, update, text)
+}
+
+// when user typed `/start`
+func startHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatID := update.Message.Chat.ID
+
+	hasSession, err := userHasSession(chatID)
+	if err != nil {
+		log.Print("Error: could not check if user has session: ", err)
+		return
+	}
+
+	if !hasSession {
+		if err := createSession(chatID); err != nil {
+			log.Print("Error: could not create new session: ", err)
+			return
+		}
+	}
+
+	session, err := getSession(chatID)
+	if err != nil {
+		log.Println("Error: could not get session: ", err)
+		return
+	}
+
+	if session.Command != "none" {
+		sendResposeIsInvalid(ctx, b, update)
+	} else {
+		// a new wizard starts a new card
+		updateSession(chatID, SessionUpdate{Command: strPtr("start"), Step: intPtr(0), CardMessageID: intPtr(0), EditingField: strPtr("")})
+		insertEmptyForm(chatID)
+
+		sendCardPrompt(ctx, b, update, "Откуда вы хотите отправиться?")
+	}
+}
+
+// when user typed `/track <откуда> <куда> <дата> [пассажиры] [вагон] [полки]`
+func trackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatID := update.Message.Chat.ID
+
+	hasSession, err := userHasSession(chatID)
+	if err != nil {
+		log.Print("Error: could not check if user has session: ", err)
+		return
+	}
+
+	if !hasSession {
+		if err := createSession(chatID); err != nil {
+			log.Print("Error: could not create new session: ", err)
+			return
+		}
+	}
+
+	session, err := getSession(chatID)
+	if err != nil {
+		log.Println("Error: could not get session: ", err)
+		return
+	}
+
+	if session.Command != "none" {
+		sendResposeIsInvalid(ctx, b, update)
+		return
+	}
+
+	form, err := parseTrackCommand(strings.Fields(update.Message.Text)[1:], time.Now().In(sessionLocation(session)))
+	if err != nil {
+		sendMessage(ctx, b, update, fmt.Sprintf("Ошибка: %s.\n\nПример: /track Москва Санкт-Петербург 2026-11-20 2 купе нижние", err))
+		return
+	}
+
+	form.ID, err = insertForm(chatID, form)
+	if err != nil {
+		log.Println("Error: track could not insert form: ", err)
+		return
+	}
+
+	sendFormSaved(ctx, b, update)
+	startMonitoring(ctx, b, update, chatID, form)
+}
+
+// when user typed `/list`
+func listHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatID := update.Message.Chat.ID
+
+	hasSession, err := userHasSession(chatID)
+	if err != nil {
+		log.Print("Error: could not check if user has session: ", err)
+		return
+	}
+
+	if !hasSession {
+		sendNoForms(ctx, b, update)
+		return
+	}
+
+	session, err := getSession(chatID)
+	if err != nil {
+		log.Println("Error: could not get session: ", err)
+		return
+	}
+
+	if args := strings.Fields(update.Message.Text)[1:]; len(args) > 0 && args[0] == "archived" {
+		archivedListHandler(ctx, b, update, chatID)
+		return
+	}
+
+	if session.Command != "none" {
+		sendResposeIsInvalid(ctx, b, update)
+	} else {
+
+		forms := savedForms(session)
+		if len(forms) == 0 {
+			sendNoForms(ctx, b, update)
+			return
+		}
+		sendListPage(ctx, b, update, chatID, forms)
+	}
+}
+
+// when user typed `/tz` or `/tz <часовой пояс>`
+func tzHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatID := update.Message.Chat.ID
+
+	hasSession, err := userHasSession(chatID)
+	if err != nil {
+		log.Print("Error: could not check if user has session: ", err)
+		return
+	}
+
+	if !hasSession {
+		if err := createSession(chatID); err != nil {
+			log.Print("Error: could not create new session: ", err)
+			return
+		}
+	}
+
+	session, err := getSession(chatID)
+	if err != nil {
+		log.Println("Error: could not get session: ", err)
+		return
+	}
+
+	args := strings.Fields(update.Message.Text)[1:]
+	if len(args) == 0 {
+		sendMessage(ctx, b, update, fmt.Sprintf("Часовой пояс: %s, сейчас %s.\n\nИзменить: /tz Asia/Yekaterinburg или /tz +5", sessionLocation(session), time.Now().In(sessionLocation(session)).Format("15:04")))
+		return
+	}
+
+	name, ok := parseTimezone(args[0])
+	if !ok {
+		sendMessage(ctx, b, update, "Не удалось распознать часовой пояс. Примеры: /tz Europe/Moscow, /tz Asia/Novosibirsk, /tz +5")
+		return
+	}
+	if err := updateSession(chatID, SessionUpdate{Timezone: &name}); err != nil {
+		log.Println("Error: could not update timezone: ", err)
+		return
+	}
+
+	loc, _ := time.LoadLocation(name)
+	sendMessage(ctx, b, update, fmt.Sprintf("Часовой пояс: %s, сейчас %s. Даты, тихие часы и дайджест считаются по нему.", name, time.Now().In(loc).Format("15:04")))
+}
+
+// when user typed `/quiet <с-по>`: sets the quiet hours, e.g. `/quiet 23:00-08:00`, `/quiet off` turns them off
+func quietHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatID := update.Message.Chat.ID
+
+	hasSession, err := userHasSession(chatID)
+	if err != nil {
+		log.Print("Error: could not check if user has session: ", err)
+		return
+	}
+
+	if !hasSession {
+		if err := createSession(chatID); err != nil {
+			log.Print("Error: could not create new session: ", err)
+			return
+		}
+	}
+
+	session, err := getSession(chatID)
+	if err != nil {
+		log.Println("Error: could not get session: ", err)
+		return
+	}
+
+	args := strings.Fields(update.Message.Text)[1:]
+	if len(args) == 0 {
+		sendMessage(ctx, b, update, notificationSettingsString(session)+"\n\nЗадать тихие часы: /quiet 23:00-08:00\nВыключить: /quiet off")
+		return
+	}
+
+	if args[0] == "off" || args[0] == "-" {
+		if err := updateSession(chatID, SessionUpdate{QuietHours: &TimeWindow{}}); err != nil {
+			log.Println("Error: could not update quiet hours: ", err)
+			return
+		}
+		sendMessage(ctx, b, update, "Тихие часы выключены.")
+		return
+	}
+
+	window, ok := parseTimeWindow(strings.Join(args, " "))
+	if !ok {
+		sendMessage(ctx, b, update, "Не удалось распознать интервал. Пример: /quiet 23:00-08:00")
+		return
+	}
+	if err := updateSession(chatID, SessionUpdate{QuietHours: &window}); err != nil {
+		log.Println("Error: could not update quiet hours: ", err)
+		return
+	}
+
+	sendEnumButtonList(ctx, b, update, quietModes, QuietMode.Label, fmt.Sprintf("Тихие часы: %s. Что делать с уведомлениями в это время?", window), func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+		mode := QuietMode(data)
+		if err := updateSession(chatID, SessionUpdate{QuietMode: &mode}); err != nil {
+			log.Println("Error: could not update quiet mode: ", err)
+			return
+		}
+		sendMessage(ctx, b, update, fmt.Sprintf("Тихие часы %s: %s.", window, strings.ToLower(mode.Label())))
+	})
+}
+
+// when user typed `/digest`: picks the digest mode, `/digest <минуты>` sets the digest interval
+func digestHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatID := update.Message.Chat.ID
+
+	hasSession, err := userHasSession(chatID)
+	if err != nil {
+		log.Print("Error: could not check if user has session: ", err)
+		return
+	}
+
+	if !hasSession {
+		if err := createSession(chatID); err != nil {
+			log.Print("Error: could not create new session: ", err)
+			return
+		}
+	}
+
+	session, err := getSession(chatID)
+	if err != nil {
+		log.Println("Error: could not get session: ", err)
+		return
+	}
+
+	if args := strings.Fields(update.Message.Text)[1:]; len(args) > 0 {
+		minutes, err := strconv.Atoi(args[0])
+		if err != nil || minutes <= 0 {
+			sendMessage(ctx, b, update, "Укажите интервал в минутах, например /digest 30")
+			return
+		}
+		mode := DigestInterval
+		if err := updateSession(chatID, SessionUpdate{DigestMode: &mode, DigestEvery: &minutes}); err != nil {
+			log.Println("Error: could not update digest: ", err)
+			return
+		}
+		sendMessage(ctx, b, update, fmt.Sprintf("Сводка изменений будет приходить каждые %d мин.", minutes))
+		return
+	}
+
+	sendEnumButtonList(ctx, b, update, digestModes, DigestMode.Label, notificationSettingsString(session)+"\n\nКак присылать изменения?", func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+		mode := DigestMode(data)
+		minutes := session.DigestEvery
+		if mode == DigestInterval && minutes <= 0 {
+			minutes = defaultDigestInterval
+		}
+		if err := updateSession(chatID, SessionUpdate{DigestMode: &mode, DigestEvery: &minutes}); err != nil {
+			log.Println("Error: could not update digest: ", err)
+			return
+		}
+
+		switch mode {
+		case DigestInterval:
+			sendMessage(ctx, b, update, fmt.Sprintf("Сводка изменений будет приходить каждые %d мин. Изменить интервал: /digest <минуты>", minutes))
+		case DigestDaily:
+			sendMessage(ctx, b, update, fmt.Sprintf("Сводка изменений будет приходить раз в день в %02d:00.", digestDailyHour))
+		default:
+			sendMessage(ctx, b, update, "Уведомления будут приходить сразу.")
+		}
+	})
+}
+
+// when user typed `/list archived`: forms whose departure date has passed
+func archivedListHandler(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64) {
+	archived, err := getArchivedForms(chatID)
+	if err != nil {
+		log.Println("Error: could not get archived forms: ", err)
+		return
+	}
+
+	if len(archived) == 0 {
+		sendMessage(ctx, b, update, "Архив пуст.")
+		return
+	}
+
+	sendArchivePage(ctx, b, update, chatID, archived)
+}
+
+// when user typed `/status`
+func statusHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	chatID := update.Message.Chat.ID
+
+	hasSession, err := userHasSession(chatID)
+	if err != nil {
+		log.Print("Error: could not check if user has session: ", err)
+		return
+	}
+
+	if !hasSession {
+		sendNoForms(ctx, b, update)
+		return
+	}
+
+	session, err := getSession(chatID)
+	if err != nil {
+		log.Println("Error: could not get session: ", err)
+		return
+	}
+
+	if session.Command != "none" {
+		sendResposeIsInvalid(ctx, b, update)
+	} else {
+
+		// sendMessage(ctx, b, update, "Список всех отслеживаемых форм:")
+		for _, form := range savedForms(session) {
+			formStatus, ok := session.FormStates[form.ID]
+			if !ok {
+				continue
+			}
+
+			text := fmt.Sprintf("Билеты на %s:", formStatus.Date.Format("02.01.2006"))
+			for _, classPrice := range formStatus.ClassPrices {
+				text += fmt.Sprintf("\n%s: %s", classPrice.Class.Label(), classPrice.Price)
+				if classPrice.Seats > 0 {
+					text += fmt.Sprintf(", свободных мест: %d", classPrice.Seats)
+				}
+			}
+			if len(formStatus.ClassPrices) == 0 {
+				text += fmt.Sprintf("\nЦена: %s", formStatus.Price)
+			}
+			for _, datePrice := range formStatus.DatePrices {
+				text += fmt.Sprintf("\n%s: %s", datePrice.Date.Format("02.01.2006"), datePrice.Price)
+			}
+			if cheapest, ok := cheapestDate(formStatus); ok {
+				text += fmt.Sprintf("\nСамая дешёвая дата: %s", cheapest.Date.Format("02.01.2006"))
+			}
+			if !formStatus.ReturnDate.IsZero() {
+				text += fmt.Sprintf("\n\nОбратно %s: \nЦена: %s", formStatus.ReturnDate.Format("02.01.2006"), formStatus.ReturnPrice)
+			}
+			sendMessage(ctx, b, update, text)
 		}
 	}
 }
@@ -2,18 +2,24 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func strPtr(s string) *string { return &s }
 func intPtr(i int) *int       { return &i }
-func stringToCompartmentNumber(s string) ([]int, bool) {
+
+// parses distinct compartment numbers 1..maxCompartment separated by spaces
+func stringToCompartmentNumber(s string, maxCompartment int) ([]int, bool) {
 	parts := strings.Fields(s)
-	if len(parts) == 0 || len(parts) > 9 {
+	if len(parts) == 0 || len(parts) > maxCompartment {
 		return nil, false
 	}
 
@@ -22,7 +28,7 @@ func stringToCompartmentNumber(s string) ([]int, bool) {
 
 	for i, p := range parts {
 		n, err := strconv.Atoi(p)
-		if err != nil || n < 1 || n > 9 || seen[n] {
+		if err != nil || n < 1 || n > maxCompartment || seen[n] {
 			return nil, false
 		}
 		seen[n] = true
@@ -38,6 +44,256 @@ func compartmentNumberToString(compartmentNumber []int) string {
 	return strings.Join(s, " ")
 }
 
+// roundTripTotal is the price of both legs for all passengers in kopecks, ok is false if any leg has no tickets
+func roundTripTotal(form Form, state FormState) (int64, bool) {
+	if !state.Price.Available() || !state.ReturnPrice.Available() {
+		return 0, false
+	}
+	return (state.Price.Amount + state.ReturnPrice.Amount) * int64(form.NumberOfPassengers), true
+}
+
+// withinRoundTripBudget reports if the round trip of the state costs at most the form budget
+func withinRoundTripBudget(form Form, state FormState) bool {
+	total, ok := roundTripTotal(form, state)
+	return ok && form.RoundTripBudget > 0 && total <= rublePrice(form.RoundTripBudget).Amount
+}
+
+// significantChange reports if the price change is worth an alert. availability changes always are,
+// a change between two prices only if the form tracks prices and it passes the threshold and direction
+func significantChange(form Form, oldPrice, newPrice Price) bool {
+	if oldPrice.Availability == Unknown || newPrice.Availability == Unknown {
+		return false
+	}
+	if oldPrice.Availability != newPrice.Availability {
+		return true
+	}
+	if !oldPrice.Available() || oldPrice.Amount == newPrice.Amount || !form.TrackPriceChange {
+		return false
+	}
+
+	delta := newPrice.Amount - oldPrice.Amount
+	switch form.ChangeDirection {
+	case ChangeDrop:
+		if delta >= 0 {
+			return false
+		}
+	case ChangeRise:
+		if delta <= 0 {
+			return false
+		}
+	}
+
+	delta = max(delta, -delta)
+	if form.ChangeThresholdPercent {
+		return delta*100 >= int64(form.ChangeThreshold)*oldPrice.Amount
+	}
+	return delta >= rublePrice(form.ChangeThreshold).Amount
+}
+
+// advanceBaseline moves the prices of the last reported state that changed significantly in state, each date and
+// leg on its own, so a slow drift of one price still adds up to an alert. a price first seen is taken over silently.
+// reports if any price moved
+func advanceBaseline(form Form, baseline, state FormState) (FormState, bool) {
+	next := state
+	moved := false
+	advance := func(oldPrice, newPrice Price) bool {
+		if oldPrice.Availability == Unknown {
+			return true
+		}
+		if significantChange(form, oldPrice, newPrice) {
+			moved = true
+			return true
+		}
+		return false
+	}
+
+	if !advance(baseline.Price, state.Price) {
+		next.Price, next.Seats, next.ClassPrices, next.Trains = baseline.Price, baseline.Seats, baseline.ClassPrices, baseline.Trains
+	}
+	if form.RoundTrip && !advance(baseline.ReturnPrice, state.ReturnPrice) {
+		next.ReturnPrice = baseline.ReturnPrice
+	}
+	next.DatePrices = slices.Clone(state.DatePrices)
+	for i, datePrice := range state.DatePrices {
+		if i < len(baseline.DatePrices) && baseline.DatePrices[i].Date.Equal(datePrice.Date) && !advance(baseline.DatePrices[i].Price, datePrice.Price) {
+			next.DatePrices[i] = baseline.DatePrices[i]
+		}
+	}
+	return next, moved
+}
+
+// bestPrice is the lowest ticket price of the state, over the whole date range for range forms
+func bestPrice(state FormState) Price {
+	if cheapest, ok := cheapestDate(state); ok {
+		return cheapest.Price
+	}
+	return state.Price
+}
+
+// bestSeats is the free seat count of the best offer of the state, 0 if not shown
+func bestSeats(state FormState) int {
+	if cheapest, ok := cheapestDate(state); ok {
+		return cheapest.Seats
+	}
+	return state.Seats
+}
+
+// underPriceCeiling reports if the best offer of the state is at or below the form price ceiling
+func underPriceCeiling(form Form, state FormState) bool {
+	price := bestPrice(state)
+	if form.PriceCeiling == 0 || !price.Available() {
+		return false
+	}
+	amount := price.Amount
+	if !form.PriceCeilingPerPassenger {
+		amount *= int64(form.NumberOfPassengers)
+	}
+	return amount <= rublePrice(form.PriceCeiling).Amount
+}
+
+func priceCeilingUnit(form Form) string {
+	if form.PriceCeilingPerPassenger {
+		return "за пассажира"
+	}
+	return "за всех"
+}
+
+// formDates lists every departure date the form watches, from DepartureDate to DepartureDateTo inclusive
+func formDates(form Form) []time.Time {
+	dates := []time.Time{form.DepartureDate}
+	for d := form.DepartureDate.AddDate(0, 0, 1); !d.After(form.DepartureDateTo); d = d.AddDate(0, 0, 1) {
+		dates = append(dates, d)
+	}
+	return dates
+}
+
+// cheapestDate finds the date with the lowest price in the range, ok is false if no date has tickets
+func cheapestDate(state FormState) (DatePrice, bool) {
+	var cheapest DatePrice
+	found := false
+	for _, datePrice := range state.DatePrices {
+		if datePrice.Price.Available() && (!found || datePrice.Price.Less(cheapest.Price)) {
+			cheapest, found = datePrice, true
+		}
+	}
+	return cheapest, found
+}
+
+// formToString describes the form the way `/list` shows it
+func formToString(form Form) string {
+	seats := ""
+	if form.ShelfType == ShelfAny {
+		seats = "Любые места"
+	} else {
+		seats = fmt.Sprintf("Нижних полок: %d\nВерхних полок: %d", form.NumberOfPassengersBottomShefl, form.NumberOfPassengersTopShefl)
+		if form.NumberOfPassengersSideShefl > 0 {
+			seats += fmt.Sprintf("\nБоковых полок: %d", form.NumberOfPassengersSideShefl)
+		}
+	}
+	if form.NoSideShefl {
+		seats += "\nБез боковых мест"
+	}
+	filters := []string{}
+	if form.DepartureWindow.isSet() {
+		filters = append(filters, "Отправление: "+form.DepartureWindow.String())
+	}
+	if form.ArrivalWindow.isSet() {
+		filters = append(filters, "Прибытие: "+form.ArrivalWindow.String())
+	}
+	if form.MaxTripDuration > 0 {
+		filters = append(filters, fmt.Sprintf("В пути не больше %d ч", int(form.MaxTripDuration.Hours())))
+	}
+	if len(form.TrainNumbers) > 0 {
+		filters = append(filters, "Поезда: "+strings.Join(form.TrainNumbers, ", "))
+	}
+	if len(filters) > 0 {
+		seats += "\n" + strings.Join(filters, "\n")
+	}
+
+	formOptions := []string{}
+	if form.TrackPriceChange {
+		trackPrice := "Отслеживать цену"
+		if form.ChangeThreshold > 0 {
+			unit := "₽"
+			if form.ChangeThresholdPercent {
+				unit = "%"
+			}
+			trackPrice += fmt.Sprintf(" (от %d %s)", form.ChangeThreshold, unit)
+		}
+		if form.ChangeDirection != "" && form.ChangeDirection != ChangeBoth {
+			trackPrice += ": " + strings.ToLower(form.ChangeDirection.Label())
+		}
+		formOptions = append(formOptions, trackPrice)
+	}
+	if form.PriceCeiling > 0 {
+		formOptions = append(formOptions, fmt.Sprintf("Не дороже %d ₽ %s", form.PriceCeiling, priceCeilingUnit(form)))
+	}
+	if form.SuggestSimilarSeats {
+		formOptions = append(formOptions, "Предлагать похожие места")
+	} else {
+		formOptions = append(formOptions, "Только выбранные места")
+	}
+	if form.Paused {
+		formOptions = append(formOptions, "На паузе")
+	}
+	if form.Inactive {
+		formOptions = append(formOptions, "Не отслеживается: бот заблокирован")
+	}
+
+	date := formDatesString(form)
+	if form.RoundTrip {
+		date += "\nОбратно: " + formatDateWithWeekday(form.ReturnDate)
+		if form.RoundTripBudget > 0 {
+			date += fmt.Sprintf("\nБюджет туда-обратно: %d ₽", form.RoundTripBudget)
+		}
+	}
+
+	text := fmt.Sprintf("Отслеживаемый маршрут: \n%s → %s\nДата: %s\nТип Вагона: %s\nКоличество Пассажиров: %d\nОтсек: %s\n%s\n%s\nНомер формы: %d", form.DeparturePoint, form.ArrivalPoint, date, form.CarriageType.Label(), form.NumberOfPassengers, compartmentNumberToString(form.CompartmentNumber), seats, strings.Join(formOptions, ",\n"), form.ID)
+	return text
+}
+
+// savedForms returns the forms of the session without the one still being filled in the wizard
+func savedForms(session Session) []Form {
+	forms := session.Forms
+	if session.Command == "start" && len(forms) > 0 {
+		forms = forms[:len(forms)-1]
+	}
+	return forms
+}
+
+// cloneForm returns a deep copy of form, so the copy can be changed independently
+func cloneForm(form Form) Form {
+	clone := form
+	clone.CompartmentNumber = append([]int{}, form.CompartmentNumber...)
+	clone.TrainNumbers = slices.Clone(form.TrainNumbers)
+	return clone
+}
+
+// splitShelves puts onShelf passengers on the shelf picked in ShelfType and the rest on the other one
+func splitShelves(form Form, onShelf int) (bottom, top, rest int) {
+	rest = form.NumberOfPassengers - onShelf
+	if form.ShelfType == ShelfTop {
+		return rest, onShelf, rest
+	}
+	return onShelf, rest, rest
+}
+
+// shelfRest is how many passengers splitShelves did not put on the picked shelf, they may go to side shelves
+func shelfRest(form Form) int {
+	if form.ShelfType == ShelfTop {
+		return form.NumberOfPassengersBottomShefl
+	}
+	return form.NumberOfPassengersTopShefl
+}
+
+// moveToSideShelves takes side passengers off the rest, the picked shelf keeps its passengers
+func moveToSideShelves(form Form, side int) (bottom, top int) {
+	if form.ShelfType == ShelfTop {
+		return form.NumberOfPassengersBottomShefl - side, form.NumberOfPassengersTopShefl
+	}
+	return form.NumberOfPassengersBottomShefl, form.NumberOfPassengersTopShefl - side
+}
+
 func remove[T comparable](l []T, item T) []T {
 	out := make([]T, 0)
 	for _, element := range l {
@@ -74,3 +330,152 @@ func getCitiesWithPrefix(prefix string) []string {
 	}
 	return result
 }
+
+// resolveCity finds the city named by name, the same way the wizard matches prefixes. an exact name wins over prefixes
+func resolveCity(name string) (string, error) {
+	foundCities := getCitiesWithPrefix(name)
+	for _, city := range foundCities {
+		if strings.EqualFold(city, name) {
+			return city, nil
+		}
+	}
+	if len(foundCities) == 0 {
+		return "", fmt.Errorf("город «%s» не найден", name)
+	}
+	if len(foundCities) > 1 {
+		sort.Strings(foundCities)
+		return "", fmt.Errorf("«%s» подходит к нескольким городам: %s", name, strings.Join(foundCities, ", "))
+	}
+	return foundCities[0], nil
+}
+
+// takeCity resolves the city at the start of tokens, trying multi-word names first. returns the remaining tokens
+func takeCity(tokens []string) (string, []string, error) {
+	for n := len(tokens); n > 1; n-- {
+		name := strings.Join(tokens[:n], " ")
+		if _, ok := cities[name]; ok {
+			return name, tokens[n:], nil
+		}
+	}
+	city, err := resolveCity(tokens[0])
+	return city, tokens[1:], err
+}
+
+func isValidNumberOfPassengers(n int) bool {
+	return n >= 1 && n <= 6
+}
+
+// takeDate parses the date at the start of tokens, it may take several of them like "20 ноября" or "через 2 недели".
+// the date is a calendar day at UTC midnight, now must be in the user's timezone
+func takeDate(tokens []string, now time.Time) (time.Time, string, []string, error) {
+	if date, err := time.Parse("2006-01-02", tokens[0]); err == nil {
+		return date, tokens[0], tokens[1:], nil
+	}
+	if date, err := time.Parse("02.01.2006", tokens[0]); err == nil {
+		return date, tokens[0], tokens[1:], nil
+	}
+
+	// the longest run of tokens that is a date, "20 ноября 2026" before "20 ноября"
+	for n := min(3, len(tokens)); n > 0; n-- {
+		text := strings.Join(tokens[:n], " ")
+		if date, ok := parseNaturalDate(text, now); ok {
+			return date, text, tokens[n:], nil
+		}
+	}
+	return time.Time{}, "", nil, fmt.Errorf("дата «%s» не распознана, используйте ГГГГ-ММ-ДД, ДД.ММ.ГГГГ или, например, «20 ноября», «завтра», «через неделю»", tokens[0])
+}
+
+// parseTrackCommand parses `/track <откуда> <куда> <дата> [пассажиры] [вагон] [полки]` arguments into a complete form
+func parseTrackCommand(args []string, now time.Time) (Form, error) {
+	form := Form{
+		NumberOfPassengers: 1,
+		CarriageType:       CarriageAny,
+		ShelfType:          ShelfAny,
+		TrackPriceChange:   true,
+	}
+
+	if len(args) < 3 {
+		return Form{}, errors.New("нужно указать откуда, куда и дату")
+	}
+
+	var err error
+	form.DeparturePoint, args, err = takeCity(args)
+	if err != nil {
+		return Form{}, fmt.Errorf("пункт отправления: %w", err)
+	}
+	if len(args) == 0 {
+		return Form{}, errors.New("не указан пункт назначения")
+	}
+	form.ArrivalPoint, args, err = takeCity(args)
+	if err != nil {
+		return Form{}, fmt.Errorf("пункт назначения: %w", err)
+	}
+	if form.DeparturePoint == form.ArrivalPoint {
+		return Form{}, errors.New("пункты отправления и назначения совпадают")
+	}
+	if len(args) == 0 {
+		return Form{}, errors.New("не указана дата")
+	}
+
+	var dateText string
+	form.DepartureDate, dateText, args, err = takeDate(args, now)
+	if err != nil {
+		return Form{}, err
+	}
+	if form.DepartureDate.Before(calendarDay(now)) {
+		return Form{}, fmt.Errorf("дата %s уже прошла", dateText)
+	}
+
+	seen := map[string]bool{}
+	for _, arg := range args {
+		kind := ""
+		if n, err := strconv.Atoi(arg); err == nil {
+			kind = "пассажиры"
+			if !isValidNumberOfPassengers(n) {
+				return Form{}, fmt.Errorf("количество пассажиров должно быть от 1 до 6, а не %d", n)
+			}
+			form.NumberOfPassengers = n
+		} else {
+			switch strings.ToLower(arg) {
+			case "любой":
+				kind, form.CarriageType = "вагон", CarriageAny
+			case "плац", "плацкарт":
+				kind, form.CarriageType = "вагон", CarriagePlackart
+			case "купе":
+				kind, form.CarriageType = "вагон", CarriageKupe
+			case "св":
+				kind, form.CarriageType = "вагон", CarriageSV
+			case "люкс":
+				kind, form.CarriageType = "вагон", CarriageLux
+			case "сид", "сидячий":
+				kind, form.CarriageType = "вагон", CarriageSitting
+			case "любые", "любое":
+				kind, form.ShelfType = "полки", ShelfAny
+			case "нижние":
+				kind, form.ShelfType = "полки", ShelfBottom
+			case "верхние":
+				kind, form.ShelfType = "полки", ShelfTop
+			default:
+				return Form{}, fmt.Errorf("непонятный параметр «%s»", arg)
+			}
+		}
+		if seen[kind] {
+			return Form{}, fmt.Errorf("параметр «%s» указан дважды", kind)
+		}
+		seen[kind] = true
+	}
+
+	form.CompartmentNumber = allCompartments(form.CarriageType)
+	if form.ShelfType != ShelfAny && !hasUpperBerths(form.CarriageType) {
+		return Form{}, fmt.Errorf("в вагоне «%s» нельзя выбрать полки", form.CarriageType.Label())
+	}
+
+	switch form.ShelfType {
+	case ShelfBottom:
+		form.NumberOfPassengersBottomShefl = form.NumberOfPassengers
+	case ShelfTop:
+		form.NumberOfPassengersTopShefl = form.NumberOfPassengers
+	}
+
+	return form, nil
+}
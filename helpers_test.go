@@ -0,0 +1,208 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignificantChange(t *testing.T) {
+	rubles := Form{TrackPriceChange: true, ChangeThreshold: 200}
+	percent := Form{TrackPriceChange: true, ChangeThreshold: 10, ChangeThresholdPercent: true}
+	drops := Form{TrackPriceChange: true, ChangeThreshold: 100, ChangeDirection: ChangeDrop}
+	rises := Form{TrackPriceChange: true, ChangeThreshold: 100, ChangeDirection: ChangeRise}
+	untracked := Form{}
+
+	tests := []struct {
+		name     string
+		form     Form
+		old, new Price
+		want     bool
+	}{
+		{"became available", untracked, priceSoldOut, rublePrice(3000), true},
+		{"sold out", untracked, rublePrice(3000), priceSoldOut, true},
+		{"went on sale sold out", untracked, priceNotOnSale, priceSoldOut, true},
+		{"unknown before", rubles, priceUnknown, rublePrice(3000), false},
+		{"unknown now", rubles, rublePrice(3000), priceUnknown, false},
+		{"prices not tracked", untracked, rublePrice(3000), rublePrice(1000), false},
+		{"same price", rubles, rublePrice(3000), rublePrice(3000), false},
+		{"below rubles threshold", rubles, rublePrice(3000), rublePrice(2801), false},
+		{"at rubles threshold", rubles, rublePrice(3000), rublePrice(2800), true},
+		{"rise over rubles threshold", rubles, rublePrice(3000), rublePrice(3300), true},
+		{"below percent threshold", percent, rublePrice(3000), rublePrice(3299), false},
+		{"at percent threshold", percent, rublePrice(3000), rublePrice(3300), true},
+		{"drop wanted", drops, rublePrice(3000), rublePrice(2000), true},
+		{"rise not wanted", drops, rublePrice(3000), rublePrice(4000), false},
+		{"rise wanted", rises, rublePrice(3000), rublePrice(4000), true},
+		{"drop not wanted", rises, rublePrice(3000), rublePrice(2000), false},
+	}
+	for _, tt := range tests {
+		if got := significantChange(tt.form, tt.old, tt.new); got != tt.want {
+			t.Errorf("%s: significantChange(%v, %v) = %v, want %v", tt.name, tt.old, tt.new, got, tt.want)
+		}
+	}
+}
+
+func TestAdvanceBaselineKeepsDrift(t *testing.T) {
+	day := time.Date(2026, 11, 20, 0, 0, 0, 0, time.UTC)
+	form := Form{TrackPriceChange: true, ChangeThreshold: 200, RoundTrip: true, DepartureDate: day, DepartureDateTo: day.AddDate(0, 0, 1)}
+	state := func(first, second, back int) FormState {
+		return FormState{
+			Price:       rublePrice(first),
+			ReturnPrice: rublePrice(back),
+			DatePrices:  []DatePrice{{Date: day, Price: rublePrice(first)}, {Date: day.AddDate(0, 0, 1), Price: rublePrice(second)}},
+		}
+	}
+
+	baseline := state(3000, 3000, 3000)
+	// every step is below the threshold, but the second date drifts past it in total
+	steps := []struct {
+		state FormState
+		moved bool
+	}{
+		{state(3000, 2900, 2900), false},
+		{state(3000, 2850, 2850), false},
+		{state(3000, 2800, 2850), true},
+		{state(3000, 2700, 2810), false},
+	}
+	for i, step := range steps {
+		var moved bool
+		baseline, moved = advanceBaseline(form, baseline, step.state)
+		if moved != step.moved {
+			t.Errorf("step %d: moved = %v, want %v", i, moved, step.moved)
+		}
+	}
+	if got := baseline.DatePrices[1].Price; got != rublePrice(2800) {
+		t.Errorf("second date baseline = %v, want 2800", got)
+	}
+	if got := baseline.ReturnPrice; got != rublePrice(3000) {
+		t.Errorf("return baseline = %v, want 3000, the return leg never moved past the threshold", got)
+	}
+	if got := baseline.Price; got != rublePrice(3000) {
+		t.Errorf("first date baseline = %v, want 3000", got)
+	}
+}
+
+func TestAdvanceBaselineTakesOverUnknown(t *testing.T) {
+	form := Form{TrackPriceChange: true, ChangeThreshold: 200}
+	baseline, moved := advanceBaseline(form, FormState{Price: priceUnknown}, FormState{Price: rublePrice(3000)})
+	if moved || baseline.Price != rublePrice(3000) {
+		t.Errorf("advanceBaseline from unknown = %v, %v, want 3000 taken over silently", baseline.Price, moved)
+	}
+}
+
+func TestWithinRoundTripBudget(t *testing.T) {
+	form := Form{RoundTrip: true, RoundTripBudget: 10000, NumberOfPassengers: 2}
+	tests := []struct {
+		name  string
+		state FormState
+		want  bool
+	}{
+		{"within for both passengers", FormState{Price: rublePrice(2500), ReturnPrice: rublePrice(2500)}, true},
+		{"over for both passengers", FormState{Price: rublePrice(3000), ReturnPrice: rublePrice(2500)}, false},
+		{"return sold out", FormState{Price: rublePrice(1000), ReturnPrice: priceSoldOut}, false},
+	}
+	for _, tt := range tests {
+		if got := withinRoundTripBudget(form, tt.state); got != tt.want {
+			t.Errorf("%s: withinRoundTripBudget = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseTrackCommand(t *testing.T) {
+	useTestCities(t)
+
+	now := time.Date(2026, 11, 18, 10, 30, 0, 0, time.FixedZone("MSK", 3*60*60))
+
+	form, err := parseTrackCommand(strings.Fields("Москва Санкт-Петербург 20.11.2026"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form.DeparturePoint != "Москва" || form.ArrivalPoint != "Санкт-Петербург" || !form.DepartureDate.Equal(time.Date(2026, 11, 20, 0, 0, 0, 0, time.UTC)) ||
+		form.NumberOfPassengers != 1 || form.CarriageType != CarriageAny || form.ShelfType != ShelfAny || !form.TrackPriceChange {
+		t.Errorf("defaults: got %+v", form)
+	}
+	if err := form.Validate(); err != nil {
+		t.Errorf("defaults: form is not valid: %v", err)
+	}
+
+	form, err = parseTrackCommand(strings.Fields("москва Нижний Новгород 20 ноября 2 купе нижние"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form.ArrivalPoint != "Нижний Новгород" || !form.DepartureDate.Equal(time.Date(2026, 11, 20, 0, 0, 0, 0, time.UTC)) ||
+		form.NumberOfPassengers != 2 || form.CarriageType != CarriageKupe || form.ShelfType != ShelfBottom || form.NumberOfPassengersBottomShefl != 2 {
+		t.Errorf("all parameters: got %+v", form)
+	}
+	if err := form.Validate(); err != nil {
+		t.Errorf("all parameters: form is not valid: %v", err)
+	}
+
+	for _, args := range []string{
+		"Москва Санкт-Петербург",
+		"Нижн Москва завтра",
+		"Москва Москва завтра",
+		"Москва Санкт-Петербург 17.11.2026",
+		"Москва Санкт-Петербург завтра 7",
+		"Москва Санкт-Петербург завтра купе плац",
+		"Москва Санкт-Петербург завтра сид нижние",
+		"Москва Санкт-Петербург завтра ракета",
+		"Москва Санкт-Петербург 31.02",
+	} {
+		if form, err := parseTrackCommand(strings.Fields(args), now); err == nil {
+			t.Errorf("parseTrackCommand(%q) = %+v, want an error", args, form)
+		}
+	}
+}
+
+func TestCloneFormIsIndependent(t *testing.T) {
+	form := Form{ID: 1, CompartmentNumber: []int{1, 2}, TrainNumbers: []string{"020У", "054Ч"}}
+	clone := cloneForm(form)
+	clone.CompartmentNumber[0] = 9
+	clone.TrainNumbers[0] = "001А"
+	if form.CompartmentNumber[0] != 1 || form.TrainNumbers[0] != "020У" {
+		t.Errorf("changing the clone changed the form: %v, %v", form.CompartmentNumber, form.TrainNumbers)
+	}
+	if cloneForm(Form{}).TrainNumbers != nil {
+		t.Error("clone of a form for any train lists trains")
+	}
+}
+
+func TestShelfAllocation(t *testing.T) {
+	tests := []struct {
+		name      string
+		shelf     ShelfType
+		onShelf   int
+		side      int
+		wantSplit [3]int // bottom, top, rest after step 4
+		wantFinal [2]int // bottom, top after step 9
+	}{
+		{"bottom", ShelfBottom, 3, 0, [3]int{3, 1, 1}, [2]int{3, 1}},
+		{"top", ShelfTop, 3, 0, [3]int{1, 3, 1}, [2]int{1, 3}},
+		{"bottom, rest on side shelves", ShelfBottom, 1, 2, [3]int{1, 3, 3}, [2]int{1, 1}},
+		{"top, rest on side shelves", ShelfTop, 1, 3, [3]int{3, 1, 3}, [2]int{0, 1}},
+		{"all on the picked shelf", ShelfBottom, 4, 0, [3]int{4, 0, 0}, [2]int{4, 0}},
+		{"none on the picked shelf", ShelfTop, 0, 1, [3]int{4, 0, 4}, [2]int{3, 0}},
+	}
+	for _, tt := range tests {
+		form := Form{CarriageType: CarriagePlackart, NumberOfPassengers: 4, ShelfType: tt.shelf}
+		bottom, top, rest := splitShelves(form, tt.onShelf)
+		if got := [3]int{bottom, top, rest}; got != tt.wantSplit {
+			t.Errorf("%s: splitShelves = %v, want %v", tt.name, got, tt.wantSplit)
+			continue
+		}
+
+		// step 4 stores the split, step 9 offers the rest for side shelves
+		form.NumberOfPassengersBottomShefl, form.NumberOfPassengersTopShefl = bottom, top
+		if got := shelfRest(form); got != rest {
+			t.Errorf("%s: shelfRest = %d, want %d", tt.name, got, rest)
+		}
+		bottom, top = moveToSideShelves(form, tt.side)
+		if got := [2]int{bottom, top}; got != tt.wantFinal {
+			t.Errorf("%s: moveToSideShelves(%d) = %v, want %v", tt.name, tt.side, got, tt.wantFinal)
+		}
+		if bottom+top+tt.side != form.NumberOfPassengers {
+			t.Errorf("%s: %d + %d + %d passengers, want %d", tt.name, bottom, top, tt.side, form.NumberOfPassengers)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+// Berth is one seat of a carriage
+type Berth struct {
+	Seat        int
+	Compartment int
+	Lower       bool
+	Side        bool
+}
+
+// CarriageLayout maps the compartments of a carriage to its seats
+type CarriageLayout struct {
+	Compartments int
+	Berths       []Berth
+	Seating      bool // seats instead of berths, no compartments or shelves to choose
+}
+
+// carriageLayouts is the one source of compartment and seat rules. CarriageAny has no layout of its own,
+// it accepts whatever any of the layouts accepts
+var carriageLayouts = map[CarriageType]CarriageLayout{
+	CarriagePlackart: plackartLayout(),
+	CarriageKupe:     kupeLayout(),
+	CarriageSV:       svLayout(),
+	CarriageLux:      luxLayout(),
+	CarriageSitting:  sittingLayout(),
+}
+
+// plackart: 9 compartments, seats 4k-3..4k in compartment k (odd lower, even upper),
+// side seats 37..54 numbered from the far end, 55-2k (lower) and 56-2k (upper) in compartment k
+func plackartLayout() CarriageLayout {
+	layout := CarriageLayout{Compartments: 9}
+	for k := 1; k <= 9; k++ {
+		for seat := 4*k - 3; seat <= 4*k; seat++ {
+			layout.Berths = append(layout.Berths, Berth{Seat: seat, Compartment: k, Lower: seat%2 == 1})
+		}
+		layout.Berths = append(layout.Berths,
+			Berth{Seat: 55 - 2*k, Compartment: k, Lower: true, Side: true},
+			Berth{Seat: 56 - 2*k, Compartment: k, Side: true},
+		)
+	}
+	return layout
+}
+
+// kupe: 9 compartments, seats 4k-3..4k in compartment k, odd lower, even upper
+func kupeLayout() CarriageLayout {
+	layout := CarriageLayout{Compartments: 9}
+	for k := 1; k <= 9; k++ {
+		for seat := 4*k - 3; seat <= 4*k; seat++ {
+			layout.Berths = append(layout.Berths, Berth{Seat: seat, Compartment: k, Lower: seat%2 == 1})
+		}
+	}
+	return layout
+}
+
+// SV: 9 compartments, two lower seats 2k-1 and 2k in compartment k
+func svLayout() CarriageLayout {
+	layout := CarriageLayout{Compartments: 9}
+	for k := 1; k <= 9; k++ {
+		layout.Berths = append(layout.Berths,
+			Berth{Seat: 2*k - 1, Compartment: k, Lower: true},
+			Berth{Seat: 2 * k, Compartment: k, Lower: true},
+		)
+	}
+	return layout
+}
+
+// lux: 6 compartments, two lower seats 2k-1 and 2k in compartment k
+func luxLayout() CarriageLayout {
+	layout := CarriageLayout{Compartments: 6}
+	for k := 1; k <= 6; k++ {
+		layout.Berths = append(layout.Berths,
+			Berth{Seat: 2*k - 1, Compartment: k, Lower: true},
+			Berth{Seat: 2 * k, Compartment: k, Lower: true},
+		)
+	}
+	return layout
+}
+
+// sitting: seats 1..68 in one open saloon, counted as compartment 1
+func sittingLayout() CarriageLayout {
+	layout := CarriageLayout{Compartments: 1, Seating: true}
+	for seat := 1; seat <= 68; seat++ {
+		layout.Berths = append(layout.Berths, Berth{Seat: seat, Compartment: 1})
+	}
+	return layout
+}
+
+// layoutsFor lists the layouts the carriage type may turn out to be
+func layoutsFor(carriageType CarriageType) []CarriageLayout {
+	if layout, ok := carriageLayouts[carriageType]; ok {
+		return []CarriageLayout{layout}
+	}
+	layouts := []CarriageLayout{}
+	for _, c := range carriageTypes {
+		if layout, ok := carriageLayouts[c]; ok {
+			layouts = append(layouts, layout)
+		}
+	}
+	return layouts
+}
+
+// maxCompartment is the highest compartment number valid for the carriage type
+func maxCompartment(carriageType CarriageType) int {
+	n := 0
+	for _, layout := range layoutsFor(carriageType) {
+		n = max(n, layout.Compartments)
+	}
+	return n
+}
+
+// allCompartments lists 1..maxCompartment, the "Любой" preset
+func allCompartments(carriageType CarriageType) []int {
+	compartments := []int{}
+	for k := 1; k <= maxCompartment(carriageType); k++ {
+		compartments = append(compartments, k)
+	}
+	return compartments
+}
+
+// hasSideBerths reports if the carriage type may have side berths
+func hasSideBerths(carriageType CarriageType) bool {
+	for _, layout := range layoutsFor(carriageType) {
+		for _, berth := range layout.Berths {
+			if berth.Side {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasCompartments reports if compartments can be chosen in the carriage type
+func hasCompartments(carriageType CarriageType) bool {
+	for _, layout := range layoutsFor(carriageType) {
+		if !layout.Seating {
+			return true
+		}
+	}
+	return false
+}
+
+// hasUpperBerths reports if the carriage type may have upper berths, so the shelf type can be chosen
+func hasUpperBerths(carriageType CarriageType) bool {
+	for _, layout := range layoutsFor(carriageType) {
+		for _, berth := range layout.Berths {
+			if !layout.Seating && !berth.Lower {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// berth finds the seat in the layout
+func (l CarriageLayout) berth(seat int) (Berth, bool) {
+	for _, berth := range l.Berths {
+		if berth.Seat == seat {
+			return berth, true
+		}
+	}
+	return Berth{}, false
+}
+
+// seatMatchesForm reports if the seat of a carriage of carriageType fits the form:
+// the compartment is chosen, and the berth type is one some passenger of the form wants
+func seatMatchesForm(form Form, carriageType CarriageType, seat int) bool {
+	if form.CarriageType != CarriageAny && form.CarriageType != carriageType {
+		return false
+	}
+	layout, ok := carriageLayouts[carriageType]
+	if !ok {
+		return false
+	}
+	berth, ok := layout.berth(seat)
+	if !ok || !contains(form.CompartmentNumber, berth.Compartment) {
+		return false
+	}
+	if berth.Side && form.NoSideShefl {
+		return false
+	}
+
+	switch {
+	case form.ShelfType == ShelfAny || layout.Seating:
+		return true
+	default:
+		if berth.Side {
+			return form.NumberOfPassengersSideShefl > 0
+		}
+		if berth.Lower {
+			return form.NumberOfPassengersBottomShefl > 0
+		}
+		return form.NumberOfPassengersTopShefl > 0
+	}
+}
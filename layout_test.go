@@ -0,0 +1,124 @@
+package main
+
+import "testing"
+
+func TestLayoutRules(t *testing.T) {
+	tests := []struct {
+		carriageType   CarriageType
+		maxCompartment int
+		sideBerths     bool
+		compartments   bool
+		upperBerths    bool
+	}{
+		{CarriagePlackart, 9, true, true, true},
+		{CarriageKupe, 9, false, true, true},
+		{CarriageSV, 9, false, true, false},
+		{CarriageLux, 6, false, true, false},
+		{CarriageSitting, 1, false, false, false},
+		{CarriageAny, 9, true, true, true},
+	}
+	for _, tt := range tests {
+		if got := maxCompartment(tt.carriageType); got != tt.maxCompartment {
+			t.Errorf("maxCompartment(%s) = %d, want %d", tt.carriageType, got, tt.maxCompartment)
+		}
+		if got := hasSideBerths(tt.carriageType); got != tt.sideBerths {
+			t.Errorf("hasSideBerths(%s) = %v, want %v", tt.carriageType, got, tt.sideBerths)
+		}
+		if got := hasCompartments(tt.carriageType); got != tt.compartments {
+			t.Errorf("hasCompartments(%s) = %v, want %v", tt.carriageType, got, tt.compartments)
+		}
+		if got := hasUpperBerths(tt.carriageType); got != tt.upperBerths {
+			t.Errorf("hasUpperBerths(%s) = %v, want %v", tt.carriageType, got, tt.upperBerths)
+		}
+		if got := len(allCompartments(tt.carriageType)); got != tt.maxCompartment {
+			t.Errorf("len(allCompartments(%s)) = %d, want %d", tt.carriageType, got, tt.maxCompartment)
+		}
+	}
+}
+
+func TestPlackartBerths(t *testing.T) {
+	layout := carriageLayouts[CarriagePlackart]
+	tests := []struct {
+		seat int
+		want Berth
+	}{
+		{1, Berth{Seat: 1, Compartment: 1, Lower: true}},
+		{4, Berth{Seat: 4, Compartment: 1}},
+		{36, Berth{Seat: 36, Compartment: 9}},
+		{53, Berth{Seat: 53, Compartment: 1, Lower: true, Side: true}},
+		{54, Berth{Seat: 54, Compartment: 1, Side: true}},
+		{37, Berth{Seat: 37, Compartment: 9, Lower: true, Side: true}},
+	}
+	for _, tt := range tests {
+		got, ok := layout.berth(tt.seat)
+		if !ok || got != tt.want {
+			t.Errorf("berth(%d) = %+v, %v, want %+v", tt.seat, got, ok, tt.want)
+		}
+	}
+	if _, ok := layout.berth(55); ok {
+		t.Errorf("berth(55) found, plackart has 54 seats")
+	}
+}
+
+func TestSeatMatchesForm(t *testing.T) {
+	plackart := Form{CarriageType: CarriagePlackart, CompartmentNumber: []int{1, 2}, ShelfType: ShelfAny}
+	notSide := plackart
+	notSide.NoSideShefl = true
+	bottom := Form{CarriageType: CarriagePlackart, CompartmentNumber: allCompartments(CarriagePlackart), ShelfType: ShelfBottom, NumberOfPassengersBottomShefl: 1}
+	side := bottom
+	side.NumberOfPassengersSideShefl = 1
+	anyCarriage := Form{CarriageType: CarriageAny, CompartmentNumber: allCompartments(CarriageAny), ShelfType: ShelfAny}
+
+	tests := []struct {
+		name         string
+		form         Form
+		carriageType CarriageType
+		seat         int
+		want         bool
+	}{
+		{"chosen compartment", plackart, CarriagePlackart, 5, true},
+		{"other compartment", plackart, CarriagePlackart, 9, false},
+		{"side berth of chosen compartment", plackart, CarriagePlackart, 53, true},
+		{"side berth not wanted", notSide, CarriagePlackart, 53, false},
+		{"other carriage type", plackart, CarriageKupe, 5, false},
+		{"unknown seat", plackart, CarriagePlackart, 99, false},
+		{"lower wanted", bottom, CarriagePlackart, 3, true},
+		{"upper not wanted", bottom, CarriagePlackart, 4, false},
+		{"side lower needs a side passenger", bottom, CarriagePlackart, 37, false},
+		{"side passenger", side, CarriagePlackart, 38, true},
+		{"any carriage", anyCarriage, CarriageSitting, 60, true},
+	}
+	for _, tt := range tests {
+		if got := seatMatchesForm(tt.form, tt.carriageType, tt.seat); got != tt.want {
+			t.Errorf("%s: seatMatchesForm(seat %d) = %v, want %v", tt.name, tt.seat, got, tt.want)
+		}
+	}
+}
+
+func TestMatchingSeats(t *testing.T) {
+	form := Form{CarriageType: CarriagePlackart, CompartmentNumber: allCompartments(CarriagePlackart), ShelfType: ShelfAny, NoSideShefl: true}
+	tests := []struct {
+		name      string
+		freeSeats []int
+		wantSeats int
+		wantFits  bool
+	}{
+		{"no seat numbers", nil, 7, true},
+		{"only side seats", []int{37, 54}, 0, false},
+		{"some fit", []int{1, 2, 37}, 2, true},
+	}
+	for _, tt := range tests {
+		classPrice := ClassPrice{Class: CarriagePlackart, Price: Price{Amount: 300000, Currency: "RUB", Availability: Available}, Seats: 7, FreeSeats: tt.freeSeats}
+		seats, fits := matchingSeats(form, classPrice)
+		if seats != tt.wantSeats || fits != tt.wantFits {
+			t.Errorf("%s: matchingSeats = %d, %v, want %d, %v", tt.name, seats, fits, tt.wantSeats, tt.wantFits)
+		}
+		wantPrice := priceSoldOut
+		if tt.wantFits {
+			wantPrice = classPrice.Price
+		}
+		if got := formPrice(form, []ClassPrice{classPrice}); got != wantPrice {
+			t.Errorf("%s: formPrice = %v, want %v", tt.name, got, wantPrice)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Telegram allows about 30 messages per second in total, one per second to a chat and 20 per minute to a group
+const (
+	globalSendInterval = time.Second / 30
+	chatSendInterval   = time.Second
+	groupSendInterval  = 3 * time.Second
+	queueDepthWarning  = 30 // the queue depth is logged from this many waiting messages
+)
+
+// rateLimiter hands out send slots in the order they are asked for, spaced by the global and the per-chat limits
+type rateLimiter struct {
+	mutex       sync.Mutex
+	nextGlobal  time.Time
+	nextChat    map[int64]time.Time
+	queued      int // messages waiting for a slot
+	queuedChats map[int64]int
+}
+
+var sendLimiter = newRateLimiter()
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{nextChat: map[int64]time.Time{}, queuedChats: map[int64]int{}}
+}
+
+func chatInterval(chatID int64) time.Duration {
+	if chatID < 0 {
+		return groupSendInterval
+	}
+	return chatSendInterval
+}
+
+// Wait blocks until a message may be sent to chatID. returns the ctx error if it is done first
+func (l *rateLimiter) Wait(ctx context.Context, chatID int64) error {
+	l.mutex.Lock()
+	now := time.Now()
+	prevGlobal, prevChat := l.nextGlobal, l.nextChat[chatID]
+	slot := now
+	if l.nextGlobal.After(slot) {
+		slot = l.nextGlobal
+	}
+	if next := l.nextChat[chatID]; next.After(slot) {
+		slot = next
+	}
+	l.nextGlobal = slot.Add(globalSendInterval)
+	l.nextChat[chatID] = slot.Add(chatInterval(chatID))
+
+	// slots far in the past are not needed to space anything out
+	for id, next := range l.nextChat {
+		if next.Before(now) {
+			delete(l.nextChat, id)
+		}
+	}
+
+	if !slot.After(now) {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.queued++
+	l.queuedChats[chatID]++
+	if l.queued >= queueDepthWarning {
+		log.Printf("Rate limiter: %d messages queued", l.queued)
+	}
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(time.Until(slot))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		l.dequeue(chatID)
+		return nil
+	case <-ctx.Done():
+		l.mutex.Lock()
+		// a cancelled message gives its slot back, unless a later message was already spaced after it
+		if l.nextGlobal.Equal(slot.Add(globalSendInterval)) {
+			l.nextGlobal = prevGlobal
+		}
+		if l.nextChat[chatID].Equal(slot.Add(chatInterval(chatID))) {
+			l.nextChat[chatID] = prevChat
+		}
+		l.mutex.Unlock()
+		l.dequeue(chatID)
+		return ctx.Err()
+	}
+}
+
+func (l *rateLimiter) dequeue(chatID int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.queued--
+	if l.queuedChats[chatID]--; l.queuedChats[chatID] == 0 {
+		delete(l.queuedChats, chatID)
+	}
+}
+
+// QueueDepth is the number of messages waiting for a slot
+func (l *rateLimiter) QueueDepth() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.queued
+}
+
+// ChatQueueDepth is the number of messages waiting for a slot to chatID
+func (l *rateLimiter) ChatQueueDepth(chatID int64) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.queuedChats[chatID]
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterSpacing(t *testing.T) {
+	l := newRateLimiter()
+	ctx := context.Background()
+
+	// the first message to a chat goes at once, the next one to the same chat waits chatSendInterval
+	start := time.Now()
+	if err := l.Wait(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited > chatSendInterval/2 {
+		t.Errorf("first message waited %v", waited)
+	}
+	if err := l.Wait(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < chatSendInterval-50*time.Millisecond {
+		t.Errorf("second message to the chat waited %v, want about %v", waited, chatSendInterval)
+	}
+
+	// another chat only waits for the global interval
+	start = time.Now()
+	if err := l.Wait(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited > chatSendInterval/2 {
+		t.Errorf("message to another chat waited %v", waited)
+	}
+}
+
+func TestRateLimiterGlobalInterval(t *testing.T) {
+	l := newRateLimiter()
+	ctx := context.Background()
+
+	start := time.Now()
+	for chatID := int64(1); chatID <= 11; chatID++ {
+		if err := l.Wait(ctx, chatID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 11 messages to different chats take 10 global intervals
+	if waited, want := time.Since(start), 10*globalSendInterval; waited < want-20*time.Millisecond {
+		t.Errorf("11 messages took %v, want at least %v", waited, want)
+	}
+}
+
+func TestRateLimiterContextDone(t *testing.T) {
+	l := newRateLimiter()
+	if err := l.Wait(context.Background(), -100); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// a group waits groupSendInterval, longer than the context lives
+	if err := l.Wait(ctx, -100); err != context.DeadlineExceeded {
+		t.Errorf("Wait = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if l.QueueDepth() != 0 || l.ChatQueueDepth(-100) != 0 {
+		t.Errorf("queue depth %d, %d for the chat after the wait gave up, want 0", l.QueueDepth(), l.ChatQueueDepth(-100))
+	}
+}
+
+func TestRateLimiterReleasesCancelledSlot(t *testing.T) {
+	l := newRateLimiter()
+	start := time.Now()
+	if err := l.Wait(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second message waits for its slot and is counted in the queue until it gives up
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- l.Wait(ctx, 1) }()
+	time.Sleep(50 * time.Millisecond)
+	if l.QueueDepth() != 1 || l.ChatQueueDepth(1) != 1 || l.ChatQueueDepth(2) != 0 {
+		t.Errorf("queue depth %d, %d for the chat, %d for another chat, want 1, 1, 0", l.QueueDepth(), l.ChatQueueDepth(1), l.ChatQueueDepth(2))
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("Wait = %v, want %v", err, context.Canceled)
+	}
+
+	// the next message takes the slot of the cancelled one instead of waiting after it
+	if err := l.Wait(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited > chatSendInterval+chatSendInterval/2 {
+		t.Errorf("message after the cancelled one waited %v, want about %v", waited, chatSendInterval)
+	}
+	if l.QueueDepth() != 0 {
+		t.Errorf("queue depth %d after all waits, want 0", l.QueueDepth())
+	}
+}
+
+func TestChatInterval(t *testing.T) {
+	if got := chatInterval(42); got != chatSendInterval {
+		t.Errorf("chatInterval(private) = %v, want %v", got, chatSendInterval)
+	}
+	if got := chatInterval(-1001); got != groupSendInterval {
+		t.Errorf("chatInterval(group) = %v, want %v", got, groupSendInterval)
+	}
+}
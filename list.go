@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	"github.com/go-telegram/ui/keyboard/inline"
+)
+
+const listPageSize = 5
+
+// `/list` is one message with listPageSize forms per page, paged by editing it
+
+// the handler of a page keyboard is unregistered when the page is redrawn, like the keyboards of the card
+type listMessage struct {
+	chatID    int64
+	messageID int
+}
+
+var (
+	listHandlersMutex sync.Mutex
+	listHandlers      = make(map[listMessage]string) // callback handler ID of the keyboard on the list message
+)
+
+// setListHandler unregisters the handler of the page keyboard the list message had before and remembers id in its place
+func setListHandler(b *bot.Bot, list listMessage, id string) {
+	listHandlersMutex.Lock()
+	defer listHandlersMutex.Unlock()
+
+	if old, ok := listHandlers[list]; ok && old != id {
+		b.UnregisterHandler(old)
+	}
+	if id == "" {
+		delete(listHandlers, list)
+	} else {
+		listHandlers[list] = id
+	}
+}
+
+func listPages(forms []Form) int {
+	return max(1, (len(forms)+listPageSize-1)/listPageSize)
+}
+
+// listPageString is the text of the page, page must be in range
+func listPageString(forms []Form, page int) string {
+	start := page * listPageSize
+	end := min(start+listPageSize, len(forms))
+
+	lines := []string{fmt.Sprintf("Отслеживаемые формы %d–%d из %d (стр. %d/%d):", start+1, end, len(forms), page+1, listPages(forms))}
+	for _, form := range forms[start:end] {
+		text := fmt.Sprintf("\n%d. %s → %s\n%s · %s · пассажиров: %d", form.ID, form.DeparturePoint, form.ArrivalPoint, formDatesString(form), form.CarriageType.Label(), form.NumberOfPassengers)
+		if form.RoundTrip {
+			text += "\nОбратно: " + formatDateWithWeekday(form.ReturnDate)
+		}
+		if form.Paused {
+			text += "\nНа паузе"
+		}
+		if form.Inactive {
+			text += "\nНе отслеживается: бот заблокирован"
+		}
+		lines = append(lines, text)
+	}
+	lines = append(lines, "\n📊 статус · ✏️ изменить · ⏸ пауза · 🗑 удалить · 📄 дублировать")
+	return strings.Join(lines, "\n")
+}
+
+// listPageKeyboard has a row of actions per form of the page and the page buttons
+func listPageKeyboard(b *bot.Bot, update *models.Update, chatID int64, forms []Form, page int) *inline.Keyboard {
+	kb := inline.New(b, inline.NoDeleteAfterClick())
+
+	start := page * listPageSize
+	end := min(start+listPageSize, len(forms))
+	for _, form := range forms[start:end] {
+		pause := "⏸"
+		if form.Paused {
+			pause = "▶️"
+		}
+		formID := form.ID
+
+		kb.Row().
+			Button(fmt.Sprintf("📊 %d", form.ID), []byte("status"), func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+				if form, ok := listForm(ctx, b, update, chatID, mes, page, formID); ok {
+					formStatusHandler(ctx, b, update, chatID, form)
+				}
+			}).
+			Button("✏️", []byte("edit"), func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+				if form, ok := listForm(ctx, b, update, chatID, mes, page, formID); ok {
+					editFormHandler(ctx, b, update, chatID, form)
+				}
+			}).
+			Button(pause, []byte("pause"), func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+				form, ok := listForm(ctx, b, update, chatID, mes, page, formID)
+				if !ok {
+					return
+				}
+				if form.Paused {
+					resumeFormHandler(ctx, b, update, chatID, form)
+				} else {
+					pauseFormHandler(ctx, b, update, chatID, form)
+				}
+				editListPage(ctx, b, update, chatID, mes, page)
+			}).
+			Button("🗑", []byte("delete"), func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+				form, ok := listForm(ctx, b, update, chatID, mes, page, formID)
+				if !ok {
+					return
+				}
+				deleteFormHandler(ctx, b, update, chatID, form, func(ctx context.Context) {
+					editListPage(ctx, b, update, chatID, mes, page)
+				})
+			}).
+			Button("📄", []byte("duplicate"), func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+				if form, ok := listForm(ctx, b, update, chatID, mes, page, formID); ok {
+					duplicateFormHandler(ctx, b, update, chatID, form)
+				}
+			})
+	}
+
+	if listPages(forms) > 1 {
+		kb.Row()
+		if page > 0 {
+			kb.Button("◀️ Назад", []byte("prev"), func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+				editListPage(ctx, b, update, chatID, mes, page-1)
+			})
+		}
+		if page < listPages(forms)-1 {
+			kb.Button("Вперёд ▶️", []byte("next"), func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+				editListPage(ctx, b, update, chatID, mes, page+1)
+			})
+		}
+	}
+
+	return kb
+}
+
+// listForm reads the form of a list button as it is now, the page may be older than the form.
+// a removed form redraws the page
+func listForm(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, mes models.MaybeInaccessibleMessage, page, formID int) (Form, bool) {
+	form, err := getFormByID(chatID, formID)
+	if err != nil {
+		log.Printf("List: form %d of chat %d is gone: %v", formID, chatID, err)
+		editListPage(ctx, b, update, chatID, mes, page)
+		return Form{}, false
+	}
+	return form, true
+}
+
+func sendListPage(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, forms []Form) {
+	if err := sendLimiter.Wait(ctx, chatID); err != nil {
+		return
+	}
+	kb := listPageKeyboard(b, update, chatID, forms, 0)
+	msg, err := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:      chatID,
+		Text:        listPageString(forms, 0),
+		ReplyMarkup: kb,
+	})
+	if err != nil {
+		log.Printf("Error: could not send list to chat %d: %v", chatID, err)
+		b.UnregisterHandler(widgetHandlerID(kb))
+		return
+	}
+	setListHandler(b, listMessage{chatID, msg.ID}, widgetHandlerID(kb))
+}
+
+// editListPage shows the page of the current forms on the list message, the page is clamped if forms were removed
+func editListPage(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, mes models.MaybeInaccessibleMessage, page int) {
+	if mes.Message == nil {
+		return
+	}
+
+	session, err := getSession(chatID)
+	if err != nil {
+		log.Println("Error: could not get session: ", err)
+		return
+	}
+	forms := savedForms(session)
+	page = min(page, listPages(forms)-1)
+
+	if err := sendLimiter.Wait(ctx, chatID); err != nil {
+		return
+	}
+
+	params := &bot.EditMessageTextParams{
+		ChatID:    chatID,
+		MessageID: mes.Message.ID,
+		Text:      "Нет форм. Зарегистрируйте форму через /start.",
+	}
+	handlerID := ""
+	if len(forms) > 0 {
+		kb := listPageKeyboard(b, update, chatID, forms, page)
+		params.Text = listPageString(forms, page)
+		params.ReplyMarkup = kb
+		handlerID = widgetHandlerID(kb)
+	}
+
+	_, err = b.EditMessageText(ctx, params)
+	if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		log.Printf("Error: could not edit list of chat %d: %v", chatID, err)
+		if handlerID != "" {
+			b.UnregisterHandler(handlerID)
+		}
+		return
+	}
+	setListHandler(b, listMessage{chatID, mes.Message.ID}, handlerID)
+}
+
+// `/list archived` pages the archive the same way, with a button to duplicate each form
+
+func archivePages(records []ArchivedForm) int {
+	return max(1, (len(records)+listPageSize-1)/listPageSize)
+}
+
+// archivePageString is the text of the archive page, page must be in range
+func archivePageString(records []ArchivedForm, page int) string {
+	start := page * listPageSize
+	end := min(start+listPageSize, len(records))
+
+	lines := []string{fmt.Sprintf("Архив форм %d–%d из %d (стр. %d/%d):", start+1, end, len(records), page+1, archivePages(records))}
+	for _, record := range records[start:end] {
+		form := record.Form
+		text := fmt.Sprintf("\n%d. %s → %s\n%s · %s · пассажиров: %d", form.ID, form.DeparturePoint, form.ArrivalPoint, formDatesString(form), form.CarriageType.Label(), form.NumberOfPassengers)
+		if record.LowestPrice.Available() {
+			text += fmt.Sprintf("\nСамая низкая цена: %s", record.LowestPrice)
+		} else {
+			text += "\nБилетов не было"
+		}
+		text += fmt.Sprintf("\nВ архиве с %s", record.Time.Format("02.01.2006"))
+		lines = append(lines, text)
+	}
+	lines = append(lines, "\n📄 дублировать")
+	return strings.Join(lines, "\n")
+}
+
+// archivePageKeyboard has a duplicate button per form of the page and the page buttons
+func archivePageKeyboard(b *bot.Bot, update *models.Update, chatID int64, records []ArchivedForm, page int) *inline.Keyboard {
+	kb := inline.New(b, inline.NoDeleteAfterClick())
+
+	start := page * listPageSize
+	end := min(start+listPageSize, len(records))
+	kb.Row()
+	for _, record := range records[start:end] {
+		kb.Button(fmt.Sprintf("📄 %d", record.Form.ID), []byte("duplicate"), func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+			duplicateFormHandler(ctx, b, update, chatID, record.Form)
+		})
+	}
+
+	if archivePages(records) > 1 {
+		kb.Row()
+		if page > 0 {
+			kb.Button("◀️ Назад", []byte("prev"), func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+				editArchivePage(ctx, b, update, chatID, mes, page-1)
+			})
+		}
+		if page < archivePages(records)-1 {
+			kb.Button("Вперёд ▶️", []byte("next"), func(ctx context.Context, b *bot.Bot, mes models.MaybeInaccessibleMessage, data []byte) {
+				editArchivePage(ctx, b, update, chatID, mes, page+1)
+			})
+		}
+	}
+
+	return kb
+}
+
+func sendArchivePage(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, records []ArchivedForm) {
+	if err := sendLimiter.Wait(ctx, chatID); err != nil {
+		return
+	}
+	kb := archivePageKeyboard(b, update, chatID, records, 0)
+	msg, err := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:      chatID,
+		Text:        archivePageString(records, 0),
+		ReplyMarkup: kb,
+	})
+	if err != nil {
+		log.Printf("Error: could not send archive to chat %d: %v", chatID, err)
+		b.UnregisterHandler(widgetHandlerID(kb))
+		return
+	}
+	setListHandler(b, listMessage{chatID, msg.ID}, widgetHandlerID(kb))
+}
+
+// editArchivePage shows the page of the archive on the archive message
+func editArchivePage(ctx context.Context, b *bot.Bot, update *models.Update, chatID int64, mes models.MaybeInaccessibleMessage, page int) {
+	if mes.Message == nil {
+		return
+	}
+
+	records, err := getArchivedForms(chatID)
+	if err != nil || len(records) == 0 {
+		return
+	}
+	page = min(page, archivePages(records)-1)
+
+	if err := sendLimiter.Wait(ctx, chatID); err != nil {
+		return
+	}
+	kb := archivePageKeyboard(b, update, chatID, records, page)
+	_, err = b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:      chatID,
+		MessageID:   mes.Message.ID,
+		Text:        archivePageString(records, page),
+		ReplyMarkup: kb,
+	})
+	if err != nil && !strings.Contains(err.Error(), "message is not modified") {
+		log.Printf("Error: could not edit archive of chat %d: %v", chatID, err)
+		b.UnregisterHandler(widgetHandlerID(kb))
+		return
+	}
+	setListHandler(b, listMessage{chatID, mes.Message.ID}, widgetHandlerID(kb))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListPageString(t *testing.T) {
+	forms := []Form{}
+	for id := 1; id <= 12; id++ {
+		forms = append(forms, Form{ID: id, DeparturePoint: "Москва", ArrivalPoint: "Казань", DepartureDate: time.Date(2026, 11, 20, 0, 0, 0, 0, time.Local), CarriageType: CarriageKupe, NumberOfPassengers: 1})
+	}
+
+	tests := []struct {
+		forms  []Form
+		page   int
+		header string
+		ids    []int
+	}{
+		{forms[:1], 0, "Отслеживаемые формы 1–1 из 1 (стр. 1/1):", []int{1}},
+		{forms[:5], 0, "Отслеживаемые формы 1–5 из 5 (стр. 1/1):", []int{1, 2, 3, 4, 5}},
+		{forms, 0, "Отслеживаемые формы 1–5 из 12 (стр. 1/3):", []int{1, 2, 3, 4, 5}},
+		{forms, 1, "Отслеживаемые формы 6–10 из 12 (стр. 2/3):", []int{6, 7, 8, 9, 10}},
+		{forms, 2, "Отслеживаемые формы 11–12 из 12 (стр. 3/3):", []int{11, 12}},
+	}
+	for _, tt := range tests {
+		text := listPageString(tt.forms, tt.page)
+		if header, _, _ := strings.Cut(text, "\n"); header != tt.header {
+			t.Errorf("%d forms, page %d: header %q, want %q", len(tt.forms), tt.page, header, tt.header)
+		}
+		for _, form := range tt.forms {
+			want := contains(tt.ids, form.ID)
+			if got := strings.Contains(text, fmt.Sprintf("\n%d. ", form.ID)); got != want {
+				t.Errorf("%d forms, page %d: form %d listed %v, want %v", len(tt.forms), tt.page, form.ID, got, want)
+			}
+		}
+	}
+
+	if got := listPages(nil); got != 1 {
+		t.Errorf("listPages(nil) = %d, want 1", got)
+	}
+}
+
+func TestArchivePageString(t *testing.T) {
+	records := []ArchivedForm{}
+	for id := 1; id <= 7; id++ {
+		form := Form{ID: id, DeparturePoint: "Москва", ArrivalPoint: "Казань", DepartureDate: time.Date(2026, 11, 20, 0, 0, 0, 0, time.UTC), CarriageType: CarriageKupe, NumberOfPassengers: 1}
+		records = append(records, ArchivedForm{Form: form, Time: time.Date(2026, 11, 21, 12, 0, 0, 0, time.UTC)})
+	}
+	records[0].LowestPrice = rublePrice(2500)
+
+	first := archivePageString(records, 0)
+	if header, _, _ := strings.Cut(first, "\n"); header != "Архив форм 1–5 из 7 (стр. 1/2):" {
+		t.Errorf("header of the first page: %q", header)
+	}
+	for _, want := range []string{"\n1. Москва → Казань", "\n5. ", "Билетов не было", "В архиве с 21.11.2026"} {
+		if !strings.Contains(first, want) {
+			t.Errorf("first page has no %q:\n%s", want, first)
+		}
+	}
+	if strings.Contains(first, "\n6. ") {
+		t.Errorf("first page lists form 6:\n%s", first)
+	}
+
+	second := archivePageString(records, 1)
+	if header, _, _ := strings.Cut(second, "\n"); header != "Архив форм 6–7 из 7 (стр. 2/2):" {
+		t.Errorf("header of the second page: %q", header)
+	}
+	if archivePages(nil) != 1 || archivePages(records) != 2 {
+		t.Errorf("archivePages: %d for none, %d for 7 forms", archivePages(nil), archivePages(records))
+	}
+}
@@ -38,8 +38,23 @@ func main() {
 		return
 	}
 
+	// bring stored records to the current format
+	err = migrateSessions()
+	if err != nil {
+		log.Println("Error: migrating stored sessions: ", err)
+		return
+	}
+
+	// move broken records out of the way before anything reads them
+	err = quarantineInvalidSessions()
+	if err != nil {
+		log.Println("Error: checking stored sessions: ", err)
+		return
+	}
+
 	opts := []bot.Option{
 		bot.WithDefaultHandler(messageHandler),
+		bot.WithMiddlewares(reactivateChat),
 	}
 
 	// read bot token
@@ -57,8 +72,20 @@ func main() {
 	}
 
 	b.RegisterHandler(bot.HandlerTypeMessageText, "start", bot.MatchTypeCommand, startHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "track", bot.MatchTypeCommand, trackHandler)
 	b.RegisterHandler(bot.HandlerTypeMessageText, "list", bot.MatchTypeCommand, listHandler)
 	b.RegisterHandler(bot.HandlerTypeMessageText, "status", bot.MatchTypeCommand, statusHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "quiet", bot.MatchTypeCommand, quietHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "digest", bot.MatchTypeCommand, digestHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "tz", bot.MatchTypeCommand, tzHandler)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, formActionPrefix, bot.MatchTypePrefix, formActionHandler)
+
+	go runNotificationScheduler(ctx)
+	go runOutboxSender(ctx, b)
+	go runStatusUpdater(ctx, b)
 
 	b.Start(ctx)
+
+	log.Println("Shutting down: stopping the monitors")
+	stopAllMonitoring()
 }
@@ -2,50 +2,310 @@ package main
 
 import "time"
 
+// enums are stored in the DB by value, labels are only for display and may change
+
+type CarriageType string
+
+const (
+	CarriageAny      CarriageType = "any"
+	CarriagePlackart CarriageType = "plackart"
+	CarriageKupe     CarriageType = "kupe"
+	CarriageSV       CarriageType = "sv"
+	CarriageLux      CarriageType = "lux"
+	CarriageSitting  CarriageType = "sitting"
+)
+
+var carriageTypeLabels = map[CarriageType]string{
+	CarriageAny:      "Любой",
+	CarriagePlackart: "Плацкарт",
+	CarriageKupe:     "Купе",
+	CarriageSV:       "СВ",
+	CarriageLux:      "Люкс",
+	CarriageSitting:  "Сидячий",
+}
+
+// in wizard order
+var carriageTypes = []CarriageType{CarriageAny, CarriagePlackart, CarriageKupe, CarriageSV, CarriageLux, CarriageSitting}
+
+func (c CarriageType) Label() string { return carriageTypeLabels[c] }
+
+type ShelfType string
+
+const (
+	ShelfAny    ShelfType = "any"
+	ShelfBottom ShelfType = "bottom"
+	ShelfTop    ShelfType = "top"
+)
+
+var shelfTypeLabels = map[ShelfType]string{
+	ShelfAny:    "Любое",
+	ShelfBottom: "Указать нижние",
+	ShelfTop:    "Указать верхние",
+}
+
+// in wizard order
+var shelfTypes = []ShelfType{ShelfAny, ShelfBottom, ShelfTop}
+
+func (s ShelfType) Label() string { return shelfTypeLabels[s] }
+
+type ChangeDirection string
+
+const (
+	ChangeBoth ChangeDirection = "both"
+	ChangeDrop ChangeDirection = "drop"
+	ChangeRise ChangeDirection = "rise"
+)
+
+var changeDirectionLabels = map[ChangeDirection]string{
+	ChangeBoth: "Снижение и рост",
+	ChangeDrop: "Только снижение",
+	ChangeRise: "Только рост",
+}
+
+// in wizard order
+var changeDirections = []ChangeDirection{ChangeBoth, ChangeDrop, ChangeRise}
+
+func (c ChangeDirection) Label() string { return changeDirectionLabels[c] }
+
+// what happens to alerts during the quiet hours of a user
+type QuietMode string
+
+const (
+	QuietSilent QuietMode = "silent" // sent without sound
+	QuietHold   QuietMode = "hold"   // held until the quiet hours end
+)
+
+var quietModeLabels = map[QuietMode]string{
+	QuietSilent: "Без звука",
+	QuietHold:   "Отложить до утра",
+}
+
+var quietModes = []QuietMode{QuietSilent, QuietHold}
+
+func (q QuietMode) Label() string { return quietModeLabels[q] }
+
+type DigestMode string
+
+const (
+	DigestOff      DigestMode = "off"
+	DigestInterval DigestMode = "interval" // every DigestInterval minutes
+	DigestDaily    DigestMode = "daily"    // once a day at digestDailyHour
+)
+
+var digestModeLabels = map[DigestMode]string{
+	DigestOff:      "Выключен",
+	DigestInterval: "Каждые N минут",
+	DigestDaily:    "Раз в день",
+}
+
+var digestModes = []DigestMode{DigestOff, DigestInterval, DigestDaily}
+
+func (d DigestMode) Label() string { return digestModeLabels[d] }
+
+// wizard choice for CompartmentNumber, not stored
+type CompartmentPreset string
+
+const (
+	CompartmentAny     CompartmentPreset = "any"
+	CompartmentNotSide CompartmentPreset = "not_side"
+	CompartmentCustom  CompartmentPreset = "custom"
+)
+
+var compartmentPresetLabels = map[CompartmentPreset]string{
+	CompartmentAny:     "Любой",
+	CompartmentNotSide: "Не боковой",
+	CompartmentCustom:  "Выбрать",
+}
+
+// in wizard order
+var compartmentPresets = []CompartmentPreset{CompartmentAny, CompartmentNotSide, CompartmentCustom}
+
+func (c CompartmentPreset) Label() string { return compartmentPresetLabels[c] }
+
 // Represents user data form
 type Form struct {
 	ID                            int
 	DeparturePoint                string
 	ArrivalPoint                  string
 	DepartureDate                 time.Time
-	CarriageType                  string
-	NumberOfPassengers            int    // invariant: 1..6
-	CompartmentNumber             []int  // invariant: non-empty list of 1..9
-	ShelfType                     string // invariant: one of "Любое", "Указать нижние", "Указать верхние"
-	NumberOfPassengersTopShefl    int    // invariant: <= NumberOfPassengers
-	NumberOfPassengersBottomShefl int    // invariant: <= NumberOfPassengers
+	DepartureDateTo               time.Time // end of the departure date range, zero for a single date. invariant: not before DepartureDate
+	RoundTrip                     bool
+	ReturnDate                    time.Time // only for RoundTrip. invariant: not before DepartureDate
+	RoundTripBudget               int       // combined price of both legs in rubles, 0 if not set
+	CarriageType                  CarriageType
+	NumberOfPassengers            int           // invariant: 1..6
+	CompartmentNumber             []int         // invariant: non-empty list of compartments of the CarriageType layout
+	NoSideShefl                   bool          // side berths are not wanted. invariant: NumberOfPassengersSideShefl is 0
+	ShelfType                     ShelfType     // invariant: one of ShelfAny, ShelfBottom, ShelfTop
+	NumberOfPassengersTopShefl    int           // invariant: <= NumberOfPassengers
+	NumberOfPassengersBottomShefl int           // invariant: <= NumberOfPassengers
+	NumberOfPassengersSideShefl   int           // invariant: 0 unless the CarriageType layout has side berths. Bottom + Top + Side == NumberOfPassengers unless ShelfType is ShelfAny
+	DepartureWindow               TimeWindow    // zero if any departure time
+	ArrivalWindow                 TimeWindow    // zero if any arrival time
+	MaxTripDuration               time.Duration // 0 if any
+	TrainNumbers                  []string      // empty if any train
 	TrackPriceChange              bool
+	ChangeThreshold               int             // smallest price change to report, 0 reports any change
+	ChangeThresholdPercent        bool            // ChangeThreshold is in percent of the old price, otherwise in rubles
+	ChangeDirection               ChangeDirection // empty means ChangeBoth
+	PriceCeiling                  int             // max price in rubles, 0 if not set
+	PriceCeilingPerPassenger      bool            // PriceCeiling is per passenger, otherwise for the whole party
 	SuggestSimilarSeats           bool
+	Paused                        bool // monitoring stopped by the user
+	Inactive                      bool // the chat blocked the bot, not monitored
+}
+
+// time of day window in minutes since midnight, wraps midnight if From > To. invariant: From != To unless zero
+type TimeWindow struct {
+	From int
+	To   int
 }
 
 type FormUpdate struct {
 	DeparturePoint                *string
 	ArrivalPoint                  *string
 	DepartureDate                 *time.Time
-	CarriageType                  *string
+	DepartureDateTo               *time.Time
+	RoundTrip                     *bool
+	ReturnDate                    *time.Time
+	RoundTripBudget               *int
+	CarriageType                  *CarriageType
 	NumberOfPassengers            *int
 	CompartmentNumber             *[]int
-	ShelfType                     *string
+	NoSideShefl                   *bool
+	ShelfType                     *ShelfType
 	NumberOfPassengersTopShefl    *int
 	NumberOfPassengersBottomShefl *int
+	NumberOfPassengersSideShefl   *int
+	DepartureWindow               *TimeWindow
+	ArrivalWindow                 *TimeWindow
+	MaxTripDuration               *time.Duration
+	TrainNumbers                  *[]string
 	TrackPriceChange              *bool
+	ChangeThreshold               *int
+	ChangeThresholdPercent        *bool
+	ChangeDirection               *ChangeDirection
+	PriceCeiling                  *int
+	PriceCeilingPerPassenger      *bool
 	SuggestSimilarSeats           *bool
 }
 
 type FormState struct {
-	Price string
-	Date  time.Time
+	Price         Price
+	Seats         int // free seats of the form carriage class for Date, 0 if not shown
+	Date          time.Time
+	Checked       time.Time // last poll of Date, zero if never
+	ReturnPrice   Price     // only for round trip forms
+	ReturnDate    time.Time
+	ReturnChecked time.Time
+	DatePrices    []DatePrice  // every date of the departure date range, only for range forms
+	ClassPrices   []ClassPrice // every carriage class on sale for Date
+	Trains        []Train      // trains of Date matching the form filters, only for forms with filters
+}
+
+// one train of the grandtrain train list
+type Train struct {
+	Number      string
+	Departure   int // minutes since midnight
+	Arrival     int // minutes since midnight
+	Duration    time.Duration
+	ClassPrices []ClassPrice
+}
+
+type ClassPrice struct {
+	Class CarriageType
+	Price Price
+	Seats int // free seats, 0 if not shown
+	// numbers of the free seats, nil if not shown
+	FreeSeats []int
+}
+
+type DatePrice struct {
+	Date    time.Time
+	Price   Price
+	Seats   int
+	Checked time.Time // last poll of the date, zero if never
+}
+
+// one recorded state of a form, key: "history:<chatID>:<formID>"
+type HistoryEntry struct {
+	Time        time.Time
+	Price       Price
+	BestPrice   Price // lowest price over the date range
+	ReturnPrice Price
+	ClassPrices []ClassPrice
+}
+
+// form moved out of a session after its departure date passed, key: "archive:<chatID>"
+type ArchivedForm struct {
+	Form        Form
+	LowestPrice Price // lowest price seen while the form was monitored
+	Time        time.Time
 }
 
 type Session struct {
-	Step        int
-	Command     string // invariant: one of "none", and other
-	Forms       []Form
-	FormsStatus []FormState
+	Step            int
+	Command         string // invariant: one of "none", and other
+	Timezone        string // IANA name, defaultTimezone if empty
+	Forms           []Form
+	NextFormID      int // invariant: above the ID of every form the session ever had
+	FormStates      map[int]FormState
+	QuietHours      TimeWindow // in Timezone, zero if none
+	QuietMode       QuietMode  // empty means QuietSilent
+	DigestMode      DigestMode // empty means DigestOff
+	DigestEvery     int        // minutes, only for DigestInterval. invariant: positive for DigestInterval
+	CardMessageID   int        // message of the wizard form card, 0 if none
+	StatusMessageID int        // pinned status message, 0 if none
+	Editing         bool       // on save the wizard form replaces the form EditingFormID
+	EditingFormID   int
+	EditingField    string // field picked in "Изменить поле", the wizard goes back to the summary once it is set
 }
 
 type SessionUpdate struct {
-	Step        *int
-	Command     *string
-	FormsStatus *[]FormState
+	Step            *int
+	Command         *string
+	Timezone        *string
+	QuietHours      *TimeWindow
+	QuietMode       *QuietMode
+	DigestMode      *DigestMode
+	DigestEvery     *int
+	CardMessageID   *int
+	StatusMessageID *int
+	Editing         *bool
+	EditingFormID   *int
+	EditingField    *string
+}
+
+// notification waiting in the outbox, key: "outbox:<created>:<EventID>"
+type OutboxMessage struct {
+	EventID     string // same events are sent once
+	ChatID      int64
+	Text        string
+	Silent      bool
+	FormID      int
+	FormActions bool // sent with the pause, history and booking buttons of FormID
+	Attempts    int
+	NotBefore   time.Time
+	Created     time.Time
+}
+
+// alert held back by quiet hours or the digest, key: "pending:<chatID>"
+type PendingNotification struct {
+	Time    time.Time
+	EventID string
+	FormID  int
+	Text    string
+}
+
+type PendingNotifications struct {
+	Held       []PendingNotification // held until the quiet hours end
+	Digest     []PendingNotification // waiting for the next digest
+	LastDigest time.Time
+}
+
+// form moved out of a session because it broke an invariant
+type QuarantinedForm struct {
+	Form  Form
+	Error string
+	Time  time.Time
 }
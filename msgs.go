@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"log"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
@@ -9,11 +10,31 @@ import (
 	"github.com/go-telegram/ui/keyboard/inline"
 )
 
+// sends msg to the chat of the update. like every send, it waits for sendLimiter first
 func sendMessage(ctx context.Context, b *bot.Bot, update *models.Update, msg string) {
-	b.SendMessage(ctx, &bot.SendMessageParams{
+	if err := sendLimiter.Wait(ctx, update.Message.Chat.ID); err != nil {
+		return
+	}
+	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID: update.Message.Chat.ID,
 		Text:   msg,
 	})
+	if err != nil {
+		log.Printf("Error: could not send message to chat %d: %v", update.Message.Chat.ID, err)
+	}
+}
+
+// sends to the chat outside of an update, e.g. from the outbox. a silent message arrives without sound
+func sendChatMessage(ctx context.Context, b *bot.Bot, chatID int64, msg string, silent bool) error {
+	if err := sendLimiter.Wait(ctx, chatID); err != nil {
+		return err
+	}
+	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:              chatID,
+		Text:                msg,
+		DisableNotification: silent,
+	})
+	return err
 }
 
 func sendResposeIsInvalid(ctx context.Context, b *bot.Bot, update *models.Update) {
@@ -39,6 +60,9 @@ func sendButtonList(ctx context.Context, b *bot.Bot, update *models.Update, name
 		citiesInlineKeyboard.Row().Button(name, []byte(name), onSelect)
 	}
 
+	if err := sendLimiter.Wait(ctx, update.Message.Chat.ID); err != nil {
+		return
+	}
 	b.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID:      update.Message.Chat.ID,
 		Text:        text,
@@ -46,9 +70,30 @@ func sendButtonList(ctx context.Context, b *bot.Bot, update *models.Update, name
 	})
 }
 
-func sendDatePicker(ctx context.Context, b *bot.Bot, update *models.Update, text string, onSelect datepicker.OnSelectHandler) {
-	kb := datepicker.New(b, onSelect)
+// like sendButtonList, but buttons show the labels and send the enum values as data
+func sendEnumButtonList[T ~string](ctx context.Context, b *bot.Bot, update *models.Update, values []T, label func(T) string, text string, onSelect inline.OnSelect) {
+	kb := inline.New(b, inline.NoDeleteAfterClick())
+
+	for _, value := range values {
+		kb.Row().Button(label(value), []byte(value), onSelect)
+	}
+
+	if err := sendLimiter.Wait(ctx, update.Message.Chat.ID); err != nil {
+		return
+	}
+	b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:      update.Message.Chat.ID,
+		Text:        text,
+		ReplyMarkup: kb,
+	})
+}
+
+func sendDatePicker(ctx context.Context, b *bot.Bot, update *models.Update, text string, onSelect datepicker.OnSelectHandler, opts ...datepicker.Option) {
+	kb := datepicker.New(b, onSelect, opts...)
 
+	if err := sendLimiter.Wait(ctx, update.Message.Chat.ID); err != nil {
+		return
+	}
 	b.SendMessage(ctx, &bot.SendMessageParams{
 		ChatID:      update.Message.Chat.ID,
 		Text:        text,
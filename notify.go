@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// the site button opens the main page of grandtrain. the site search takes the form through the ajax endpoint of
+// fetchHTML, there is no confirmed link to the results of one search, so the button does not promise booking
+const grandtrainURL = "https://grandtrain.ru/"
+
+// callback data of the form buttons on notifications: "form:<action>:<formID>". one handler registered at startup
+// answers them, so the buttons of old notifications work after a restart and act on the form as it is now
+const formActionPrefix = "form:"
+
+const (
+	formActionPause   = "pause"
+	formActionResume  = "resume"
+	formActionHistory = "history"
+)
+
+// formDatesString is the departure date of the form, or its date range
+func formDatesString(form Form) string {
+	if form.DepartureDateTo.IsZero() {
+		return formatDateWithWeekday(form.DepartureDate)
+	}
+	return form.DepartureDate.Format("02.01") + "–" + form.DepartureDateTo.Format("02.01.2006")
+}
+
+// priceChange formats "old → new", with the difference if both are prices
+func priceChange(oldPrice, newPrice Price) string {
+	text := fmt.Sprintf("%s → %s", oldPrice, newPrice)
+	if oldPrice.Available() && newPrice.Available() {
+		delta := newPrice.Amount - oldPrice.Amount
+		sign := "+"
+		if delta < 0 {
+			sign, delta = "−", -delta
+		}
+		text += fmt.Sprintf(" (%s%s ₽)", sign, formatAmount(delta))
+	}
+	return text
+}
+
+// classPrice finds the price of the class, sold out if the class is not listed
+func classPrice(classPrices []ClassPrice, class CarriageType) Price {
+	for _, classPrice := range classPrices {
+		if classPrice.Class == class {
+			return classPrice.Price
+		}
+	}
+	return priceSoldOut
+}
+
+// classChanges lists the carriage classes of the form whose price or availability changed
+func classChanges(form Form, oldPrices, newPrices []ClassPrice) []string {
+	if len(oldPrices) == 0 && len(newPrices) == 0 {
+		return nil
+	}
+	lines := []string{}
+	for _, class := range carriageTypes {
+		if class == CarriageAny || (form.CarriageType != CarriageAny && class != form.CarriageType) {
+			continue
+		}
+		oldPrice, newPrice := classPrice(oldPrices, class), classPrice(newPrices, class)
+		if oldPrice != newPrice {
+			lines = append(lines, fmt.Sprintf("%s: %s", class.Label(), priceChange(oldPrice, newPrice)))
+		}
+	}
+	return lines
+}
+
+// trainChanges lists the trains whose price for the form changed, appeared or left the list
+func trainChanges(form Form, oldTrains, newTrains []Train) []string {
+	lines := []string{}
+	seen := map[string]bool{}
+	for _, train := range newTrains {
+		seen[train.Number] = true
+		oldPrice := priceSoldOut
+		for _, oldTrain := range oldTrains {
+			if oldTrain.Number == train.Number {
+				oldPrice = formPrice(form, oldTrain.ClassPrices)
+			}
+		}
+		if newPrice := formPrice(form, train.ClassPrices); oldPrice != newPrice {
+			lines = append(lines, fmt.Sprintf("Поезд %s (%02d:%02d): %s", train.Number, train.Departure/60, train.Departure%60, priceChange(oldPrice, newPrice)))
+		}
+	}
+	for _, train := range oldTrains {
+		if oldPrice := formPrice(form, train.ClassPrices); !seen[train.Number] && oldPrice != priceSoldOut {
+			lines = append(lines, fmt.Sprintf("Поезд %s (%02d:%02d): %s", train.Number, train.Departure/60, train.Departure%60, priceChange(oldPrice, priceSoldOut)))
+		}
+	}
+	return lines
+}
+
+// transitionHeader announces tickets appearing or selling out, on the way there and back. silent is set if the
+// only news is the less urgent sell out
+func transitionHeader(oldState, newState FormState) (header string, silent bool) {
+	lines := []string{}
+	silent = true
+	switch availabilityTransition(bestPrice(oldState), bestPrice(newState)) {
+	case BecameAvailable:
+		line := "🟢 Билеты появились!"
+		if seats := bestSeats(newState); seats > 0 {
+			line += fmt.Sprintf(" Свободных мест: %d", seats)
+		}
+		lines, silent = append(lines, line), false
+	case BecameSoldOut:
+		lines = append(lines, "🔴 Билеты закончились.")
+	}
+	switch availabilityTransition(oldState.ReturnPrice, newState.ReturnPrice) {
+	case BecameAvailable:
+		lines, silent = append(lines, "🟢 Обратные билеты появились!"), false
+	case BecameSoldOut:
+		lines = append(lines, "🔴 Обратные билеты закончились.")
+	}
+	if len(lines) == 0 {
+		return "", false
+	}
+	return strings.Join(lines, "\n") + "\n\n", silent
+}
+
+// changeNotification describes what changed between two states of the form
+func changeNotification(form Form, oldState, newState FormState, detected time.Time) string {
+	text := fmt.Sprintf("🔔 Форма %d: %s → %s\nДата: %s", form.ID, form.DeparturePoint, form.ArrivalPoint, formDatesString(form))
+	if form.RoundTrip {
+		text += fmt.Sprintf("\nОбратно: %s", formatDateWithWeekday(form.ReturnDate))
+	}
+
+	changes := classChanges(form, oldState.ClassPrices, newState.ClassPrices)
+	if len(changes) == 0 && oldState.Price != newState.Price {
+		changes = append(changes, fmt.Sprintf("Цена: %s", priceChange(oldState.Price, newState.Price)))
+	}
+	if form.RoundTrip && oldState.ReturnPrice != newState.ReturnPrice {
+		changes = append(changes, fmt.Sprintf("Обратно: %s", priceChange(oldState.ReturnPrice, newState.ReturnPrice)))
+	}
+	for i, datePrice := range newState.DatePrices {
+		if i < len(oldState.DatePrices) && oldState.DatePrices[i].Price != datePrice.Price {
+			changes = append(changes, fmt.Sprintf("%s: %s", datePrice.Date.Format("02.01"), priceChange(oldState.DatePrices[i].Price, datePrice.Price)))
+		}
+	}
+	if len(changes) > 0 {
+		text += "\n\n" + strings.Join(changes, "\n")
+	}
+	if cheapest, ok := cheapestDate(newState); ok {
+		text += fmt.Sprintf("\nСамая дешёвая дата: %s (%s)", cheapest.Date.Format("02.01"), cheapest.Price)
+	}
+
+	if trains := trainChanges(form, oldState.Trains, newState.Trains); len(trains) > 0 {
+		text += "\n\n" + strings.Join(trains, "\n")
+	}
+
+	text += fmt.Sprintf("\n\nОбнаружено: %s", detected.Format("02.01 15:04"))
+	return text
+}
+
+// underCeilingNotification tells that the form already has an offer under its price ceiling
+func underCeilingNotification(form Form, state FormState) string {
+	text := fmt.Sprintf("Цена не выше порога %d ₽ %s!\n🔔 Форма %d: %s → %s\nДата: %s\nЦена: %s", form.PriceCeiling, priceCeilingUnit(form), form.ID, form.DeparturePoint, form.ArrivalPoint, formDatesString(form), bestPrice(state))
+	if seats := bestSeats(state); seats > 0 {
+		text += fmt.Sprintf("\nСвободных мест: %d", seats)
+	}
+	return text
+}
+
+// formActionData is the callback data of a form button
+func formActionData(action string, formID int) string {
+	return fmt.Sprintf("%s%s:%d", formActionPrefix, action, formID)
+}
+
+// parseFormActionData splits the callback data of a form button
+func parseFormActionData(data string) (action string, formID int, ok bool) {
+	if !strings.HasPrefix(data, formActionPrefix) {
+		return "", 0, false
+	}
+	action, id, found := strings.Cut(strings.TrimPrefix(data, formActionPrefix), ":")
+	if !found {
+		return "", 0, false
+	}
+	formID, err := strconv.Atoi(id)
+	if err != nil {
+		return "", 0, false
+	}
+	return action, formID, true
+}
+
+// notificationMarkup has the buttons to pause the form, show its history and open the site
+func notificationMarkup(form Form) models.InlineKeyboardMarkup {
+	return models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{
+		{
+			{Text: "Пауза", CallbackData: formActionData(formActionPause, form.ID)},
+			{Text: "История", CallbackData: formActionData(formActionHistory, form.ID)},
+		},
+		{{Text: "Открыть grandtrain.ru", URL: grandtrainURL}},
+	}}
+}
+
+// sends the change notification with the form buttons. a silent notification arrives without sound
+func sendChangeNotification(ctx context.Context, b *bot.Bot, chatID int64, form Form, text string, silent bool) error {
+	if err := sendLimiter.Wait(ctx, chatID); err != nil {
+		return err
+	}
+	_, err := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:              chatID,
+		Text:                text,
+		ReplyMarkup:         notificationMarkup(form),
+		DisableNotification: silent,
+	})
+	return err
+}
+
+// when user pressed a form button of a notification: the form is read again, it may be changed or gone by now
+func formActionHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	query := update.CallbackQuery
+	answer := &bot.AnswerCallbackQueryParams{CallbackQueryID: query.ID}
+	defer func() {
+		if _, err := b.AnswerCallbackQuery(ctx, answer); err != nil {
+			log.Println("Error: could not answer callback query: ", err)
+		}
+	}()
+
+	action, formID, ok := parseFormActionData(query.Data)
+	if !ok || query.Message.Message == nil {
+		log.Printf("Error: unknown form action %q", query.Data)
+		return
+	}
+	chatID := query.Message.Message.Chat.ID
+
+	form, err := getFormByID(chatID, formID)
+	if err != nil {
+		answer.Text = fmt.Sprintf("Формы %d больше нет.", formID)
+		return
+	}
+
+	switch action {
+	case formActionPause:
+		pauseFormHandler(ctx, b, chatUpdate(chatID), chatID, form)
+	case formActionResume:
+		resumeFormHandler(ctx, b, chatUpdate(chatID), chatID, form)
+	case formActionHistory:
+		historyHandler(ctx, b, chatUpdate(chatID), chatID, form)
+	default:
+		log.Printf("Error: unknown form action %q", query.Data)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+func TestTransitionHeader(t *testing.T) {
+	// the free seats come from the data-seats of the date strip
+	entry := findDateEntries(loadFixture(t, "grandtrain_dates.html"), "2026-11-19")[0]
+	form := Form{CarriageType: CarriagePlackart, CompartmentNumber: allCompartments(CarriagePlackart), ShelfType: ShelfAny}
+	onSale := FormState{Price: formPrice(form, entry), Seats: formSeats(form, entry), ReturnPrice: rublePrice(2000)}
+
+	tests := []struct {
+		name       string
+		old, new   FormState
+		wantHeader string
+		wantSilent bool
+	}{
+		{"no change", onSale, onSale, "", false},
+		{"became available", FormState{Price: priceSoldOut, ReturnPrice: rublePrice(2000)}, onSale, "🟢 Билеты появились! Свободных мест: 12\n\n", false},
+		{"sold out", onSale, FormState{Price: priceSoldOut, ReturnPrice: rublePrice(2000)}, "🔴 Билеты закончились.\n\n", true},
+		{"return became available", FormState{Price: onSale.Price, Seats: 12, ReturnPrice: priceNotOnSale}, onSale, "🟢 Обратные билеты появились!\n\n", false},
+		{"return sold out", onSale, FormState{Price: onSale.Price, Seats: 12, ReturnPrice: priceSoldOut}, "🔴 Обратные билеты закончились.\n\n", true},
+		{"both", FormState{Price: priceSoldOut, ReturnPrice: rublePrice(2000)}, FormState{Price: onSale.Price, Seats: 12, ReturnPrice: priceSoldOut}, "🟢 Билеты появились! Свободных мест: 12\n🔴 Обратные билеты закончились.\n\n", false},
+		{"unknown return", onSale, FormState{Price: onSale.Price, Seats: 12, ReturnPrice: priceUnknown}, "", false},
+		{"one way", FormState{Price: priceSoldOut}, FormState{Price: rublePrice(1000)}, "🟢 Билеты появились!\n\n", false},
+	}
+	for _, tt := range tests {
+		header, silent := transitionHeader(tt.old, tt.new)
+		if header != tt.wantHeader || silent != tt.wantSilent {
+			t.Errorf("%s: transitionHeader = %q, %v, want %q, %v", tt.name, header, silent, tt.wantHeader, tt.wantSilent)
+		}
+	}
+}
+
+func TestFormActionData(t *testing.T) {
+	for _, action := range []string{formActionPause, formActionResume, formActionHistory} {
+		gotAction, gotID, ok := parseFormActionData(formActionData(action, 42))
+		if !ok || gotAction != action || gotID != 42 {
+			t.Errorf("%s: parsed %q, %d, %v", action, gotAction, gotID, ok)
+		}
+	}
+	for _, data := range []string{"", "form:", "form:pause", "form:pause:x", "list:pause:1"} {
+		if _, _, ok := parseFormActionData(data); ok {
+			t.Errorf("parseFormActionData(%q) ok", data)
+		}
+	}
+
+	// the callback data must fit the 64 bytes Telegram allows
+	markup := notificationMarkup(Form{ID: 1 << 30})
+	for _, row := range markup.InlineKeyboard {
+		for _, button := range row {
+			if len(button.CallbackData) > 64 {
+				t.Errorf("%s: callback data %q is too long", button.Text, button.CallbackData)
+			}
+		}
+	}
+}
+
+// newTestBot is a bot talking to a fake API that accepts every call
+func newTestBot(t *testing.T) *bot.Bot {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true,"result":true}`))
+	}))
+	t.Cleanup(server.Close)
+	b, err := bot.New("test", bot.WithSkipGetMe(), bot.WithServerURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestFormActionHandlerReadsCurrentForm(t *testing.T) {
+	openTestDB(t)
+	useTestCities(t)
+	b := newTestBot(t)
+	const chatID = 3
+
+	if err := createSession(chatID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := insertForm(chatID, testForm(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the notification was sent for the form before it was changed
+	old := testForm(0)
+	old.NumberOfPassengers = 1
+	edited := testForm(0)
+	edited.NumberOfPassengers = 4
+	if err := changeSession(chatID, func(txn *badger.Txn, session *Session) error {
+		session.Forms[0] = edited
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	press := func(data string) {
+		formActionHandler(context.Background(), b, &models.Update{CallbackQuery: &models.CallbackQuery{
+			ID:      "1",
+			Data:    data,
+			Message: models.MaybeInaccessibleMessage{Message: &models.Message{Chat: models.Chat{ID: chatID}}},
+		}})
+	}
+
+	press(formActionData(formActionPause, old.ID))
+	form, err := getFormByID(chatID, old.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !form.Paused || form.NumberOfPassengers != 4 {
+		t.Errorf("after pause: %+v, want the edited form paused", form)
+	}
+
+	// a removed form is only told about
+	press(formActionData(formActionPause, 7))
+	if _, err := getFormByID(chatID, 7); err == nil {
+		t.Errorf("form 7 appeared")
+	}
+}
+
+func TestUnderCeilingNotification(t *testing.T) {
+	form := Form{ID: 5, DeparturePoint: "Москва", ArrivalPoint: "Казань", DepartureDate: time.Date(2026, 11, 20, 0, 0, 0, 0, time.UTC), NumberOfPassengers: 2, PriceCeiling: 5000}
+	state := FormState{Price: rublePrice(2400), Seats: 3}
+	if !underPriceCeiling(form, state) {
+		t.Fatal("2 × 2400 ₽ is not under 5000 ₽ for all")
+	}
+	want := "Цена не выше порога 5000 ₽ за всех!\n🔔 Форма 5: Москва → Казань\nДата: пт, 20.11.2026\nЦена: " + rublePrice(2400).String() + "\nСвободных мест: 3"
+	if got := underCeilingNotification(form, state); got != want {
+		t.Errorf("underCeilingNotification = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+const (
+	outboxPollInterval = time.Second
+	outboxMaxAttempts  = 10
+	outboxMaxBackoff   = 5 * time.Minute
+)
+
+// eventID derives a stable ID of an event from what it is about, so the same event is sent once
+func eventID(parts ...any) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%v", parts)))
+	return hex.EncodeToString(sum[:])
+}
+
+// chatUpdate stands in for the update of a handler when sending to chatID from the background
+func chatUpdate(chatID int64) *models.Update {
+	return &models.Update{Message: &models.Message{Chat: models.Chat{ID: chatID}}}
+}
+
+// enqueueMessage queues a plain message for the outbox sender
+func enqueueMessage(chatID int64, event, text string, silent bool) {
+	now := time.Now()
+	message := OutboxMessage{EventID: event, ChatID: chatID, Text: text, Silent: silent, NotBefore: now, Created: now}
+	if stored, err := enqueueOutboxMessage(message); err == nil && !stored {
+		log.Printf("Outbox: skipping duplicate event %s (chat %d)", event, chatID)
+	}
+}
+
+// enqueueChangeNotification queues a change notification, sent with the buttons of the form
+func enqueueChangeNotification(chatID int64, form Form, event, text string, silent bool) {
+	now := time.Now()
+	message := OutboxMessage{EventID: event, ChatID: chatID, Text: text, Silent: silent, FormID: form.ID, FormActions: true, NotBefore: now, Created: now}
+	if stored, err := enqueueOutboxMessage(message); err == nil && !stored {
+		log.Printf("Outbox: skipping duplicate event %s (chat %d)", event, chatID)
+	}
+}
+
+// outboxBackoff doubles the wait with every failed attempt, up to outboxMaxBackoff
+func outboxBackoff(attempts int) time.Duration {
+	backoff := time.Second << min(attempts, 16)
+	return min(backoff, outboxMaxBackoff)
+}
+
+func sendOutboxMessage(ctx context.Context, b *bot.Bot, message OutboxMessage) error {
+	if message.FormActions {
+		// the form may be archived by now, then the text goes without buttons
+		if form, err := getFormByID(message.ChatID, message.FormID); err == nil {
+			return sendChangeNotification(ctx, b, message.ChatID, form, message.Text, message.Silent)
+		}
+	}
+	return sendChatMessage(ctx, b, message.ChatID, message.Text, message.Silent)
+}
+
+// blockedChat drops what is queued for a chat that blocked the bot and stops monitoring its forms
+func blockedChat(chatID int64) {
+	dropped, _ := dropChatOutbox(chatID)
+	ids, err := deactivateForms(chatID)
+	if err != nil {
+		log.Printf("Error: could not deactivate forms of chat %d: %v", chatID, err)
+	}
+	for _, id := range ids {
+		stopMonitoring(chatID, id)
+	}
+	log.Printf("Outbox: chat %d blocked the bot, dropped %d messages, deactivated %d forms", chatID, dropped, len(ids))
+}
+
+// reactivateChat is a middleware: any update from a chat that blocked the bot before means it is back, its forms are
+// active again and the monitors of those not paused start
+func reactivateChat(next bot.HandlerFunc) bot.HandlerFunc {
+	return func(ctx context.Context, b *bot.Bot, update *models.Update) {
+		chatID := int64(0)
+		switch {
+		case update.Message != nil:
+			chatID = update.Message.Chat.ID
+		case update.CallbackQuery != nil && update.CallbackQuery.Message.Message != nil:
+			chatID = update.CallbackQuery.Message.Message.Chat.ID
+		}
+
+		if chatID != 0 {
+			forms, err := reactivateForms(chatID)
+			if err != nil {
+				log.Printf("Error: could not reactivate forms of chat %d: %v", chatID, err)
+			}
+			if len(forms) > 0 {
+				log.Printf("Chat %d is back, reactivated %d forms", chatID, len(forms))
+				go func() {
+					for _, form := range forms {
+						if !form.Paused {
+							launchMonitor(chatID, form)
+						}
+					}
+				}()
+			}
+		}
+
+		next(ctx, b, update)
+	}
+}
+
+// runOutboxSender drains the outbox in order until ctx is done. a message is deleted once Telegram accepted it,
+// or when it can never be delivered
+func runOutboxSender(ctx context.Context, b *bot.Bot) {
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+
+		key, message, ok, err := nextOutboxMessage(time.Now())
+		if err != nil || !ok {
+			wait = outboxPollInterval
+			continue
+		}
+		wait = 0
+
+		err = sendOutboxMessage(ctx, b, message)
+		var tooMany *bot.TooManyRequestsError
+		switch {
+		case err == nil:
+			deleteOutboxMessage(key)
+		case errors.As(err, &tooMany):
+			// the flood limit holds for the whole bot, so the sender waits as a whole
+			wait = time.Duration(tooMany.RetryAfter) * time.Second
+			log.Printf("Outbox: too many requests, retrying in %s", wait)
+		case errors.Is(err, bot.ErrorForbidden):
+			blockedChat(message.ChatID)
+		case errors.Is(err, bot.ErrorBadRequest):
+			log.Printf("Error: outbox message to chat %d rejected, dropping it: %v", message.ChatID, err)
+			deleteOutboxMessage(key)
+		default:
+			message.Attempts++
+			if message.Attempts >= outboxMaxAttempts {
+				log.Printf("Error: giving up on outbox message to chat %d after %d attempts: %v", message.ChatID, message.Attempts, err)
+				deleteOutboxMessage(key)
+				continue
+			}
+			message.NotBefore = time.Now().Add(outboxBackoff(message.Attempts))
+			log.Printf("Outbox: sending to chat %d failed (attempt %d), retrying at %s: %v", message.ChatID, message.Attempts, message.NotBefore.Format("15:04:05"), err)
+			updateOutboxMessage(key, message)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, time.Second},
+		{1, 2 * time.Second},
+		{5, 32 * time.Second},
+		{8, 256 * time.Second},
+		{9, outboxMaxBackoff},
+		{100, outboxMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := outboxBackoff(tt.attempts); got != tt.want {
+			t.Errorf("outboxBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestEventIDIsStable(t *testing.T) {
+	if eventID("change", int64(1), 2) != eventID("change", int64(1), 2) {
+		t.Errorf("eventID differs for the same parts")
+	}
+	if eventID("change", int64(1), 2) == eventID("change", int64(1), 3) {
+		t.Errorf("eventID is the same for different parts")
+	}
+}
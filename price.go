@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+type Availability string
+
+const (
+	Available Availability = "available"
+	SoldOut   Availability = "sold_out"    // the date is on sale, but there are no tickets
+	NotOnSale Availability = "not_on_sale" // the date is not on sale (yet)
+	Unknown   Availability = "unknown"     // the page could not tell
+)
+
+// Price is a scraped ticket price. Amount is only meaningful if Available
+type Price struct {
+	Amount       int64 // kopecks
+	Currency     string
+	Availability Availability
+}
+
+var (
+	priceSoldOut   = Price{Availability: SoldOut}
+	priceNotOnSale = Price{Availability: NotOnSale}
+	priceUnknown   = Price{Availability: Unknown}
+)
+
+// parsePrice parses a price string the way grandtrain prints it: "от 2 345 ₽", "2 345,50 руб." with regular,
+// non-breaking or thin spaces, or "2.345" with a dot between thousands. "-" means the tickets are sold out
+func parsePrice(s string) Price {
+	s = strings.TrimSpace(s)
+	if s == "-" || s == "—" {
+		return priceSoldOut
+	}
+
+	var whole, fraction strings.Builder
+	done, inFraction := false, false
+	for i, r := range s {
+		if done {
+			break
+		}
+		switch {
+		case r >= '0' && r <= '9':
+			if inFraction {
+				fraction.WriteRune(r)
+			} else {
+				whole.WriteRune(r)
+			}
+		case r == '.' && whole.Len() > 0 && !inFraction && !centsFollow(s[i+1:]):
+			// thousands separator
+		case (r == ',' || r == '.') && whole.Len() > 0 && !inFraction:
+			inFraction = true
+		case r == ' ' || r == '\u00a0' || r == '\u2009' || r == '\u202f':
+			// thousands separators
+		default:
+			// the number ended, e.g. "2 345 ₽"
+			done = whole.Len() > 0
+		}
+	}
+	if whole.Len() == 0 {
+		return priceUnknown
+	}
+
+	rubles, err := strconv.ParseInt(whole.String(), 10, 64)
+	if err != nil {
+		return priceUnknown
+	}
+	kopecks := int64(0)
+	if f := fraction.String(); f != "" {
+		f = (f + "00")[:2]
+		kopecks, _ = strconv.ParseInt(f, 10, 64)
+	}
+
+	return Price{Amount: rubles*100 + kopecks, Currency: "RUB", Availability: Available}
+}
+
+// centsFollow reports if exactly two digits follow a dot, then it separates kopecks and not thousands
+func centsFollow(s string) bool {
+	digits := 0
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			break
+		}
+		digits++
+	}
+	return digits == 2
+}
+
+// rublePrice makes an available price from whole rubles
+func rublePrice(rubles int) Price {
+	return Price{Amount: int64(rubles) * 100, Currency: "RUB", Availability: Available}
+}
+
+func (p Price) Available() bool {
+	return p.Availability == Available
+}
+
+// Less orders available prices by amount, unavailable ones after them
+func (p Price) Less(q Price) bool {
+	if p.Available() != q.Available() {
+		return p.Available()
+	}
+	return p.Amount < q.Amount
+}
+
+// Rubles is the amount rounded down to whole rubles
+func (p Price) Rubles() int {
+	return int(p.Amount / 100)
+}
+
+func (p Price) String() string {
+	switch p.Availability {
+	case Available:
+		return formatAmount(p.Amount) + " ₽"
+	case SoldOut:
+		return "нет билетов"
+	case NotOnSale:
+		return "продажа не открыта"
+	default:
+		return "неизвестно"
+	}
+}
+
+// formatAmount formats kopecks as rubles with a thousands separator, e.g. "2 345" or "2 345,50"
+func formatAmount(kopecks int64) string {
+	digits := strconv.FormatInt(kopecks/100, 10)
+	var s strings.Builder
+	for i, r := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			s.WriteRune('\u00a0')
+		}
+		s.WriteRune(r)
+	}
+	if k := kopecks % 100; k != 0 {
+		s.WriteString("," + strconv.FormatInt(100+k, 10)[1:])
+	}
+	return s.String()
+}
+
+// Transition is a change of ticket availability between two polls
+type Transition int
+
+const (
+	NoTransition    Transition = iota
+	BecameAvailable            // tickets appeared: sold out or not on sale before
+	BecameSoldOut              // the last tickets are gone
+)
+
+// availabilityTransition classifies the change between two prices. unknown prices never transition
+func availabilityTransition(oldPrice, newPrice Price) Transition {
+	if oldPrice.Availability == Unknown || newPrice.Availability == Unknown {
+		return NoTransition
+	}
+	switch {
+	case !oldPrice.Available() && newPrice.Available():
+		return BecameAvailable
+	case oldPrice.Available() && newPrice.Availability == SoldOut:
+		return BecameSoldOut
+	}
+	return NoTransition
+}
+
+// UnmarshalJSON also reads the price strings stored before prices were parsed
+func (p *Price) UnmarshalJSON(data []byte) error {
+	var legacy string
+	if err := json.Unmarshal(data, &legacy); err == nil {
+		if legacy == "" {
+			*p = priceUnknown
+		} else {
+			*p = parsePrice(legacy)
+		}
+		return nil
+	}
+
+	type price Price
+	return json.Unmarshal(data, (*price)(p))
+}
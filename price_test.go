@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+func TestParsePrice(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Price
+	}{
+		{"от 2 345 ₽", rublePrice(2345)},
+		{"от 2\u00a0345\u202f₽", rublePrice(2345)},
+		{"2 345 руб.", rublePrice(2345)},
+		{"2 345", rublePrice(2345)},
+		{"2 345,50 руб.", Price{Amount: 234550, Currency: "RUB", Availability: Available}},
+		{"2345,5", Price{Amount: 234550, Currency: "RUB", Availability: Available}},
+		{"2345.50 ₽", Price{Amount: 234550, Currency: "RUB", Availability: Available}},
+		{"2.345", rublePrice(2345)},
+		{"12.345 ₽", rublePrice(12345)},
+		{"1.234.567", rublePrice(1234567)},
+		{"1.234,50", Price{Amount: 123450, Currency: "RUB", Availability: Available}},
+		{"990", rublePrice(990)},
+		{"-", priceSoldOut},
+		{"—", priceSoldOut},
+		{"", priceUnknown},
+		{"нет мест", priceUnknown},
+	}
+	for _, tt := range tests {
+		if got := parsePrice(tt.in); got != tt.want {
+			t.Errorf("parsePrice(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		kopecks int64
+		want    string
+	}{
+		{99000, "990"},
+		{234500, "2\u00a0345"},
+		{234550, "2\u00a0345,50"},
+		{123456700, "1\u00a0234\u00a0567"},
+	}
+	for _, tt := range tests {
+		if got := formatAmount(tt.kopecks); got != tt.want {
+			t.Errorf("formatAmount(%d) = %q, want %q", tt.kopecks, got, tt.want)
+		}
+	}
+}
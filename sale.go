@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+const (
+	saleHorizonDays  = 90 // tickets go on sale this many days before departure
+	saleOpeningHour  = 8  // hour of Moscow time the sale of a new date opens
+	saleWakeLead     = 10 * time.Minute
+	saleBurstLength  = 30 * time.Minute // how long after the opening the faster polling lasts
+	pollInterval     = 2 * time.Second
+	salePollInterval = time.Second            // step of the burst schedule, counted from the opening
+	salePollJitter   = 500 * time.Millisecond // polls of a burst are spread over this much after each step
+)
+
+// requests to grandtrain across all monitors: fetchBudgetRate per second on average, fetchBudgetBurst at once
+const (
+	fetchBudgetRate  = 4
+	fetchBudgetBurst = 8
+)
+
+// dateSaleOpening is the moment the tickets for a departure date go on sale
+func dateSaleOpening(date time.Time) time.Time {
+	moscow, err := time.LoadLocation(defaultTimezone)
+	if err != nil {
+		moscow = time.UTC
+	}
+	y, m, d := date.Date()
+	return time.Date(y, m, d, saleOpeningHour, 0, 0, 0, moscow).AddDate(0, 0, -saleHorizonDays)
+}
+
+// saleOpening is the moment the first tickets of the form go on sale, the other dates of a range follow a day apart
+func saleOpening(form Form) time.Time {
+	return dateSaleOpening(form.DepartureDate)
+}
+
+// saleDates lists every date of the form that goes on sale on its own: the departure dates and the return date
+func saleDates(form Form) []time.Time {
+	dates := formDates(form)
+	if form.RoundTrip {
+		dates = append(dates, form.ReturnDate)
+	}
+	return dates
+}
+
+// inSaleBurst reports if the sale of the date opens shortly or has just opened
+func inSaleBurst(date, now time.Time) bool {
+	opening := dateSaleOpening(date)
+	return now.After(opening.Add(-saleWakeLead)) && now.Before(opening.Add(saleBurstLength))
+}
+
+// saleJustOpened reports if the sale of the date opened less than saleBurstLength ago
+func saleJustOpened(date, now time.Time) bool {
+	opening := dateSaleOpening(date)
+	return !now.Before(opening) && now.Before(opening.Add(saleBurstLength))
+}
+
+// nextPollInterval polls faster from shortly before the sale opening of any date of the form until the burst after
+// it is over. burst polls of all monitors follow the same schedule, a step of salePollInterval from the opening, each
+// poll jitter after its step, so the forms of one opening do not drift into each other and the first poll is right
+// after the opening
+func nextPollInterval(form Form, now time.Time, jitter time.Duration) time.Duration {
+	for _, date := range saleDates(form) {
+		if inSaleBurst(date, now) {
+			opening := dateSaleOpening(date)
+			step := opening.Add(now.Sub(opening).Truncate(salePollInterval))
+			if !step.After(now) {
+				step = step.Add(salePollInterval)
+			}
+			return step.Sub(now) + jitter
+		}
+	}
+	return pollInterval
+}
+
+func pollJitter() time.Duration {
+	return rand.N(salePollJitter)
+}
+
+// fetchBudget is a token bucket shared by all monitors, so a sale opening of many forms does not flood grandtrain
+type fetchBudget struct {
+	mutex   sync.Mutex
+	tokens  float64
+	updated time.Time
+}
+
+var grandtrainBudget = &fetchBudget{}
+
+// take reports if a request may be made now and uses it up
+func (f *fetchBudget) take(now time.Time) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	switch {
+	case f.updated.IsZero():
+		f.tokens, f.updated = fetchBudgetBurst, now
+	case now.After(f.updated):
+		f.tokens = min(fetchBudgetBurst, f.tokens+now.Sub(f.updated).Seconds()*fetchBudgetRate)
+		f.updated = now
+	}
+	if f.tokens < 1 {
+		return false
+	}
+	f.tokens--
+	return true
+}
+
+// saleOpeningString tells when the sale of the form opens, with the later dates of a range
+func saleOpeningString(form Form, loc *time.Location) string {
+	text := saleOpening(form).In(loc).Format("02.01 в 15:04")
+	if !form.DepartureDateTo.IsZero() {
+		text += fmt.Sprintf(", следующие даты — по одной в день до %s", dateSaleOpening(form.DepartureDateTo).In(loc).Format("02.01"))
+	}
+	return text
+}
+
+// saleWaitPlan tells how long to sleep until the wake before the opening, and until the reminder the day before.
+// remind is false if the reminder time has passed, startMonitoring has already told about the opening then.
+// wake is not positive if the monitor should poll at once
+func saleWaitPlan(opening, now time.Time) (wake, reminder time.Duration, remind bool) {
+	wake = opening.Add(-saleWakeLead).Sub(now)
+	reminder = opening.Add(-24 * time.Hour).Sub(now)
+	return wake, reminder, wake > 0 && reminder > 0
+}
+
+// waitForSaleOpening sleeps until shortly before the sale of the form opens, sending a reminder the day before.
+// returns false if monitoring was stopped meanwhile
+func waitForSaleOpening(ctxm context.Context, chatID int64, form Form) bool {
+	opening := saleOpening(form)
+	wakeIn, reminderIn, remind := saleWaitPlan(opening, time.Now())
+	if wakeIn <= 0 {
+		return true
+	}
+
+	var reminder <-chan time.Time
+	if remind {
+		timer := time.NewTimer(reminderIn)
+		defer timer.Stop()
+		reminder = timer.C
+	}
+	wake := time.NewTimer(wakeIn)
+	defer wake.Stop()
+
+	for {
+		select {
+		case <-reminder:
+			loc := time.Local
+			if session, err := getSession(chatID); err == nil {
+				loc = sessionLocation(session)
+			}
+			deliverNotification(chatID, form, eventID("sale-reminder", chatID, form.ID, opening), fmt.Sprintf("⏰ Продажа билетов по форме %d (%s → %s, %s) откроется %s.", form.ID, form.DeparturePoint, form.ArrivalPoint, formDatesString(form), saleOpeningString(form, loc)), false)
+		case <-wake.C:
+			return true
+		case <-ctxm.Done():
+			return false
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDateSaleOpening(t *testing.T) {
+	tests := []struct {
+		date time.Time
+		want time.Time
+	}{
+		{time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 2, 5, 0, 0, 0, time.UTC)},
+		{time.Date(2027, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 12, 1, 5, 0, 0, 0, time.UTC)},
+		// the day of the date counts, not the moment: a late hour of the same day opens at the same time
+		{time.Date(2027, 3, 1, 23, 0, 0, 0, time.UTC), time.Date(2026, 12, 1, 5, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := dateSaleOpening(tt.date); !got.Equal(tt.want) {
+			t.Errorf("dateSaleOpening(%v) = %v, want %v", tt.date, got.UTC(), tt.want)
+		}
+	}
+
+	form := Form{DepartureDate: time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC), DepartureDateTo: time.Date(2027, 1, 3, 0, 0, 0, 0, time.UTC)}
+	if got := saleOpening(form); !got.Equal(dateSaleOpening(form.DepartureDate)) {
+		t.Errorf("saleOpening of a range = %v, want the opening of its first date", got)
+	}
+}
+
+func TestSaleBurst(t *testing.T) {
+	date := time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)
+	opening := dateSaleOpening(date)
+
+	tests := []struct {
+		now        time.Time
+		burst      bool
+		justOpened bool
+	}{
+		{opening.Add(-saleWakeLead - time.Second), false, false},
+		{opening.Add(-saleWakeLead + time.Second), true, false},
+		{opening.Add(-time.Nanosecond), true, false},
+		{opening, true, true},
+		{opening.Add(saleBurstLength - time.Second), true, true},
+		{opening.Add(saleBurstLength), false, false},
+	}
+	for _, tt := range tests {
+		at := tt.now.Sub(opening)
+		if got := inSaleBurst(date, tt.now); got != tt.burst {
+			t.Errorf("inSaleBurst at %v from the opening = %v, want %v", at, got, tt.burst)
+		}
+		if got := saleJustOpened(date, tt.now); got != tt.justOpened {
+			t.Errorf("saleJustOpened at %v from the opening = %v, want %v", at, got, tt.justOpened)
+		}
+	}
+}
+
+func TestNextPollInterval(t *testing.T) {
+	form := Form{DepartureDate: time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)}
+	opening := dateSaleOpening(form.DepartureDate)
+	jitter := 200 * time.Millisecond
+
+	tests := []struct {
+		now  time.Time
+		want time.Duration
+	}{
+		// outside the burst the jitter is not used
+		{opening.Add(-time.Hour), pollInterval},
+		{opening.Add(time.Hour), pollInterval},
+		// in the burst the poll waits for the next step of the shared schedule
+		{opening.Add(-300 * time.Millisecond), 300*time.Millisecond + jitter},
+		{opening, salePollInterval + jitter},
+		{opening.Add(5*time.Minute + 250*time.Millisecond), 750*time.Millisecond + jitter},
+	}
+	for _, tt := range tests {
+		if got := nextPollInterval(form, tt.now, jitter); got != tt.want {
+			t.Errorf("nextPollInterval at %v from the opening = %v, want %v", tt.now.Sub(opening), got, tt.want)
+		}
+	}
+}
+
+func TestFetchBudget(t *testing.T) {
+	budget := &fetchBudget{}
+	now := time.Date(2026, 10, 2, 5, 0, 0, 0, time.UTC)
+
+	for i := range fetchBudgetBurst {
+		if !budget.take(now) {
+			t.Fatalf("request %d of the burst refused", i+1)
+		}
+	}
+	if budget.take(now) {
+		t.Error("request over the burst allowed")
+	}
+	if !budget.take(now.Add(time.Second / fetchBudgetRate)) {
+		t.Error("request refused after the budget refilled one")
+	}
+	if budget.take(now.Add(time.Second / fetchBudgetRate)) {
+		t.Error("second request allowed after the budget refilled one")
+	}
+}
+
+func TestSaleWaitPlan(t *testing.T) {
+	opening := time.Date(2026, 10, 2, 5, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		now          time.Time
+		wake         time.Duration
+		reminder     time.Duration
+		remind, wait bool
+	}{
+		{"days before", opening.Add(-72 * time.Hour), 72*time.Hour - saleWakeLead, 48 * time.Hour, true, true},
+		{"just before the reminder", opening.Add(-24*time.Hour - time.Minute), 24*time.Hour + time.Minute - saleWakeLead, time.Minute, true, true},
+		{"within a day", opening.Add(-time.Hour), time.Hour - saleWakeLead, -23 * time.Hour, false, true},
+		{"after the wake", opening.Add(-time.Minute), time.Minute - saleWakeLead, -24*time.Hour + time.Minute, false, false},
+	}
+	for _, tt := range tests {
+		wake, reminder, remind := saleWaitPlan(opening, tt.now)
+		if wake != tt.wake || reminder != tt.reminder || remind != tt.remind || (wake > 0) != tt.wait {
+			t.Errorf("%s: wake in %v, reminder in %v, remind %v, want %v, %v, %v", tt.name, wake, reminder, remind, tt.wake, tt.reminder, tt.remind)
+		}
+	}
+}
+
+func TestWaitForSaleOpening(t *testing.T) {
+	// on sale already: the monitor polls at once
+	onSale := Form{DepartureDate: calendarDay(time.Now().AddDate(0, 0, 10))}
+	if !waitForSaleOpening(context.Background(), 1, onSale) {
+		t.Error("waitForSaleOpening of a form on sale = false")
+	}
+
+	// a stopped monitor does not wait for the opening
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	later := Form{DepartureDate: calendarDay(time.Now().AddDate(0, 0, saleHorizonDays+10))}
+	if waitForSaleOpening(ctx, 1, later) {
+		t.Error("waitForSaleOpening after the monitor stopped = true")
+	}
+}
+
+func TestPollTargets(t *testing.T) {
+	first := time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC)
+	form := Form{DepartureDate: first, DepartureDateTo: first.AddDate(0, 0, 3), RoundTrip: true, ReturnDate: first.AddDate(0, 0, 10)}
+	now := dateSaleOpening(form.ReturnDate).Add(time.Hour)
+
+	checked := func(minutes int) time.Time { return now.Add(-time.Duration(minutes) * time.Minute) }
+	state := FormState{
+		DatePrices: []DatePrice{
+			{Date: first, Checked: checked(5)},
+			{Date: first.AddDate(0, 0, 1), Checked: checked(20)},
+			{Date: first.AddDate(0, 0, 2), Checked: checked(1)},
+			{Date: first.AddDate(0, 0, 3)}, // never polled
+		},
+		ReturnChecked: checked(10),
+	}
+
+	indexes := func(targets []pollTarget) []int {
+		out := []int{}
+		for _, target := range targets {
+			out = append(out, target.index)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name  string
+		state FormState
+		now   time.Time
+		want  []int
+	}{
+		{"least recently checked first", state, now, []int{3, 1, -1, 0, 2}},
+		{"polled dates go to the end", func() FormState {
+			s := state
+			s.DatePrices = slices.Clone(state.DatePrices)
+			s.DatePrices[3].Checked, s.DatePrices[1].Checked = now, now
+			return s
+		}(), now.Add(time.Second), []int{-1, 0, 2, 1, 3}},
+		// the sale of the last date of the range has just opened, only it is polled
+		{"just opened", state, dateSaleOpening(form.DepartureDateTo).Add(time.Minute), []int{3}},
+	}
+	for _, tt := range tests {
+		if got := indexes(pollTargets(form, tt.state, tt.now)); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: targets %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot"
+)
+
+const (
+	statusCheckInterval = 5 * time.Second
+	statusEditInterval  = time.Minute // at most one edit of the pinned status per chat in this time
+)
+
+// every chat has one pinned message with a table of its active forms, edited when a monitor records a change
+
+// last poll of a monitored form
+type formCheck struct {
+	Price   Price // best price of the form
+	Checked time.Time
+}
+
+var (
+	statusMutex   sync.Mutex
+	formChecks    = make(map[monitoringKey]formCheck)
+	statusChanged = make(map[int64]bool)      // chats whose pinned status is out of date
+	statusEdited  = make(map[int64]time.Time) // last edit of the pinned status per chat
+)
+
+// recordCheck remembers the result of a successful poll of the form
+func recordCheck(chatID int64, formID int, state FormState) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	formChecks[monitoringKey{chatID, formID}] = formCheck{Price: bestPrice(state), Checked: time.Now()}
+}
+
+// forgetCheck drops the last poll of a form that is no longer monitored
+func forgetCheck(chatID int64, formID int) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	delete(formChecks, monitoringKey{chatID, formID})
+}
+
+// markStatusChanged asks for an edit of the pinned status of the chat, done by runStatusUpdater
+func markStatusChanged(chatID int64) {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+	statusChanged[chatID] = true
+}
+
+// lastCheck returns the last poll of the form, falling back to the history after a restart
+func lastCheck(chatID int64, formID int) (formCheck, bool) {
+	statusMutex.Lock()
+	check, ok := formChecks[monitoringKey{chatID, formID}]
+	statusMutex.Unlock()
+	if ok {
+		return check, true
+	}
+
+	history, err := getFormHistory(chatID, formID)
+	if err != nil || len(history) == 0 {
+		return formCheck{}, false
+	}
+	entry := history[len(history)-1]
+	return formCheck{Price: entry.BestPrice, Checked: entry.Time}, true
+}
+
+func availabilityMark(price Price) string {
+	switch price.Availability {
+	case Available:
+		return "🟢"
+	case SoldOut:
+		return "🔴"
+	case NotOnSale:
+		return "⏳"
+	default:
+		return "❔"
+	}
+}
+
+// statusTableString is the text of the pinned status: one line per active form
+func statusTableString(chatID int64, session Session, now time.Time) string {
+	loc := sessionLocation(session)
+	lines := []string{"📌 Отслеживаемые формы"}
+	for _, form := range savedForms(session) {
+		if form.Paused || form.Inactive {
+			continue
+		}
+		price, checked := priceUnknown, "—"
+		if check, ok := lastCheck(chatID, form.ID); ok {
+			price, checked = check.Price, check.Checked.In(loc).Format("15:04")
+		}
+		lines = append(lines, fmt.Sprintf("%s %d. %s → %s, %s: %s · %s", availabilityMark(price), form.ID, form.DeparturePoint, form.ArrivalPoint, formDatesString(form), price, checked))
+	}
+	if len(lines) == 1 {
+		lines = append(lines, "Нет активных форм. Зарегистрируйте форму через /start.")
+	}
+	if queued := sendLimiter.ChatQueueDepth(chatID); queued > 0 {
+		lines = append(lines, "", fmt.Sprintf("✉️ Сообщений в очереди на отправку: %d", queued))
+	}
+	lines = append(lines, "", "Обновлено "+now.In(loc).Format("02.01 15:04"))
+	return strings.Join(lines, "\n")
+}
+
+// refreshStatusMessage edits the pinned status of the chat, or sends and pins a new one if it is gone
+func refreshStatusMessage(ctx context.Context, b *bot.Bot, chatID int64) error {
+	session, err := getSession(chatID)
+	if err != nil {
+		return err
+	}
+	text := statusTableString(chatID, session, time.Now())
+
+	if err := sendLimiter.Wait(ctx, chatID); err != nil {
+		return err
+	}
+
+	if session.StatusMessageID != 0 {
+		_, err := b.EditMessageText(ctx, &bot.EditMessageTextParams{
+			ChatID:    chatID,
+			MessageID: session.StatusMessageID,
+			Text:      text,
+		})
+		var tooMany *bot.TooManyRequestsError
+		switch {
+		case err == nil || strings.Contains(err.Error(), "message is not modified"):
+			return nil
+		case errors.As(err, &tooMany) || errors.Is(err, bot.ErrorForbidden):
+			return err
+		}
+		log.Printf("Status: could not edit status %d of chat %d, sending a new one: %v", session.StatusMessageID, chatID, err)
+	}
+
+	msg, err := b.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:              chatID,
+		Text:                text,
+		DisableNotification: true,
+	})
+	if err != nil {
+		return err
+	}
+	updateSession(chatID, SessionUpdate{StatusMessageID: &msg.ID})
+
+	_, err = b.PinChatMessage(ctx, &bot.PinChatMessageParams{
+		ChatID:              chatID,
+		MessageID:           msg.ID,
+		DisableNotification: true,
+	})
+	if err != nil {
+		log.Printf("Status: could not pin status of chat %d: %v", chatID, err)
+	}
+	return nil
+}
+
+// dueStatusChats takes the chats whose pinned status changed and was not edited for statusEditInterval, the
+// others wait for a later tick
+func dueStatusChats(now time.Time) []int64 {
+	statusMutex.Lock()
+	defer statusMutex.Unlock()
+
+	due := []int64{}
+	for chatID := range statusChanged {
+		if now.Sub(statusEdited[chatID]) >= statusEditInterval {
+			due = append(due, chatID)
+			delete(statusChanged, chatID)
+			statusEdited[chatID] = now
+		}
+	}
+	return due
+}
+
+// runStatusUpdater edits the pinned status of chats with changes, at most once per statusEditInterval, until ctx is done
+func runStatusUpdater(ctx context.Context, b *bot.Bot) {
+	ticker := time.NewTicker(statusCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, chatID := range dueStatusChats(time.Now()) {
+				err := refreshStatusMessage(ctx, b, chatID)
+				var tooMany *bot.TooManyRequestsError
+				switch {
+				case err == nil:
+				case errors.As(err, &tooMany):
+					// try again on a later tick
+					markStatusChanged(chatID)
+				case errors.Is(err, bot.ErrorForbidden):
+					blockedChat(chatID)
+				default:
+					log.Printf("Error: could not update status of chat %d: %v", chatID, err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
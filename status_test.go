@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatusTableString(t *testing.T) {
+	openTestDB(t)
+	const chatID = 5
+
+	checked, paused, inactive, restarted, never := testForm(1), testForm(2), testForm(3), testForm(4), testForm(5)
+	paused.Paused, inactive.Inactive = true, true
+	session := Session{Command: "none", Timezone: "Asia/Yekaterinburg", Forms: []Form{checked, paused, inactive, restarted, never}}
+
+	polled := time.Date(2026, 10, 19, 7, 30, 0, 0, time.UTC)
+	statusMutex.Lock()
+	formChecks[monitoringKey{chatID, checked.ID}] = formCheck{Price: rublePrice(2500), Checked: polled}
+	statusMutex.Unlock()
+	// after a restart the last poll comes from the history
+	if err := appendFormHistory(chatID, restarted.ID, FormState{Price: priceSoldOut}, polled.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { forgetCheck(chatID, checked.ID) })
+
+	text := statusTableString(chatID, session, polled.Add(time.Minute))
+	lines := strings.Split(text, "\n")
+	wantLines := []string{
+		"📌 Отслеживаемые формы",
+		fmt.Sprintf("🟢 1. Москва → Казань, %s: %s · 12:30", formDatesString(checked), rublePrice(2500)),
+		fmt.Sprintf("🔴 4. Москва → Казань, %s: %s · 11:30", formDatesString(restarted), priceSoldOut),
+		fmt.Sprintf("❔ 5. Москва → Казань, %s: %s · —", formDatesString(never), priceUnknown),
+		"",
+		"Обновлено 19.10 12:31",
+	}
+	if !slices.Equal(lines, wantLines) {
+		t.Errorf("status table:\n%s\nwant:\n%s", text, strings.Join(wantLines, "\n"))
+	}
+
+	text = statusTableString(chatID, Session{Forms: []Form{paused}}, polled)
+	if !strings.Contains(text, "Нет активных форм") {
+		t.Errorf("status table without active forms:\n%s", text)
+	}
+}
+
+func TestDueStatusChats(t *testing.T) {
+	now := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	// other tests mark their chats too
+	statusMutex.Lock()
+	savedChanged, savedEdited := statusChanged, statusEdited
+	statusChanged, statusEdited = map[int64]bool{}, map[int64]time.Time{}
+	statusMutex.Unlock()
+	t.Cleanup(func() {
+		statusMutex.Lock()
+		defer statusMutex.Unlock()
+		statusChanged, statusEdited = savedChanged, savedEdited
+	})
+
+	markStatusChanged(6)
+	markStatusChanged(7)
+	statusMutex.Lock()
+	statusEdited[7] = now.Add(-statusEditInterval / 2)
+	statusMutex.Unlock()
+
+	// chat 7 was edited recently and waits, chat 6 is edited now
+	due := dueStatusChats(now)
+	if !slices.Equal(due, []int64{6}) {
+		t.Errorf("due at first: %v, want [6]", due)
+	}
+	markStatusChanged(6)
+	if due := dueStatusChats(now.Add(statusEditInterval / 2)); !slices.Equal(due, []int64{7}) {
+		t.Errorf("due half an interval later: %v, want [7]", due)
+	}
+	if due := dueStatusChats(now.Add(statusEditInterval)); !slices.Equal(due, []int64{6}) {
+		t.Errorf("due an interval later: %v, want [6]", due)
+	}
+	if due := dueStatusChats(now.Add(2 * statusEditInterval)); len(due) != 0 {
+		t.Errorf("due without changes: %v", due)
+	}
+}
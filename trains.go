@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// classes of the grandtrain train list elements
+const (
+	trainItemClass      = "train-item"
+	trainNumberClass    = "train-number"
+	trainDepartureClass = "train-time-departure"
+	trainArrivalClass   = "train-time-arrival"
+	trainDurationClass  = "train-time-travel"
+	trainPricesClass    = "train-prices"
+)
+
+var (
+	clockRe    = regexp.MustCompile(`(\d{1,2}):(\d{2})`)
+	durationRe = regexp.MustCompile(`(?:(\d+)\s*д\S*)?\s*(?:(\d+)\s*ч\S*)?\s*(?:(\d+)\s*м\S*)?`)
+)
+
+// hasTrainFilters reports if the form watches only some of the trains
+func hasTrainFilters(form Form) bool {
+	return form.DepartureWindow.isSet() || form.ArrivalWindow.isSet() || form.MaxTripDuration > 0 || len(form.TrainNumbers) > 0
+}
+
+func (w TimeWindow) isSet() bool {
+	return w != TimeWindow{}
+}
+
+// contains reports if the minute of the day is in the window, a window like 22:00-02:00 wraps midnight
+func (w TimeWindow) contains(minute int) bool {
+	if !w.isSet() {
+		return true
+	}
+	if w.From <= w.To {
+		return minute >= w.From && minute <= w.To
+	}
+	return minute >= w.From || minute <= w.To
+}
+
+func (w TimeWindow) String() string {
+	return fmt.Sprintf("%02d:%02d–%02d:%02d", w.From/60, w.From%60, w.To/60, w.To%60)
+}
+
+// parseTimeWindow parses "18:00-23:00"
+func parseTimeWindow(s string) (TimeWindow, bool) {
+	m := clockRe.FindAllStringSubmatch(s, -1)
+	if len(m) != 2 {
+		return TimeWindow{}, false
+	}
+	from, ok := clockToMinute(m[0])
+	if !ok {
+		return TimeWindow{}, false
+	}
+	to, ok := clockToMinute(m[1])
+	if !ok || from == to {
+		return TimeWindow{}, false
+	}
+	return TimeWindow{From: from, To: to}, true
+}
+
+func clockToMinute(m []string) (int, bool) {
+	h, _ := strconv.Atoi(m[1])
+	min, _ := strconv.Atoi(m[2])
+	if h > 23 || min > 59 {
+		return 0, false
+	}
+	return h*60 + min, true
+}
+
+// parseTrainNumbers parses train numbers separated by spaces or commas, e.g. "020У, 016А"
+func parseTrainNumbers(s string) []string {
+	numbers := []string{}
+	for _, number := range strings.FieldsFunc(s, func(r rune) bool { return r == ' ' || r == ',' }) {
+		numbers = append(numbers, strings.ToUpper(number))
+	}
+	return numbers
+}
+
+// trainMatchesForm applies the form filters to a train
+func trainMatchesForm(form Form, train Train) bool {
+	if !form.DepartureWindow.contains(train.Departure) || !form.ArrivalWindow.contains(train.Arrival) {
+		return false
+	}
+	if form.MaxTripDuration > 0 && train.Duration > form.MaxTripDuration {
+		return false
+	}
+	if len(form.TrainNumbers) > 0 && !contains(form.TrainNumbers, strings.ToUpper(train.Number)) {
+		return false
+	}
+	return true
+}
+
+// filteredPrice picks the cheapest price of the form carriage class among the trains matching the form filters.
+// not on sale if there are no trains, sold out if none of them has tickets
+func filteredPrice(form Form, trains []Train) (Price, []Train) {
+	if len(trains) == 0 {
+		return priceNotOnSale, nil
+	}
+	price := priceSoldOut
+	matching := []Train{}
+	for _, train := range trains {
+		if !trainMatchesForm(form, train) {
+			continue
+		}
+		matching = append(matching, train)
+		if trainPrice := formPrice(form, train.ClassPrices); trainPrice.Less(price) {
+			price = trainPrice
+		}
+	}
+	return price, matching
+}
+
+// trainsSeats counts the free seats of the form carriage class over the trains
+func trainsSeats(form Form, trains []Train) int {
+	seats := 0
+	for _, train := range trains {
+		seats += formSeats(form, train.ClassPrices)
+	}
+	return seats
+}
+
+// parseTrains reads the train list of the response
+func parseTrains(doc *html.Node) []Train {
+	var trains []Train
+
+	var traverse func(*html.Node)
+	traverse = func(n *html.Node) {
+		if n.Type == html.ElementNode && hasClass(n, trainItemClass) {
+			trains = append(trains, parseTrain(n))
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			traverse(c)
+		}
+	}
+	traverse(doc)
+
+	return trains
+}
+
+func parseTrain(n *html.Node) Train {
+	var train Train
+	if number := findDescendantWithClass(n, trainNumberClass); number != nil {
+		train.Number = getTextContent(number)
+	}
+	if departure := findDescendantWithClass(n, trainDepartureClass); departure != nil {
+		if m := clockRe.FindStringSubmatch(getTextContent(departure)); m != nil {
+			train.Departure, _ = clockToMinute(m)
+		}
+	}
+	if arrival := findDescendantWithClass(n, trainArrivalClass); arrival != nil {
+		if m := clockRe.FindStringSubmatch(getTextContent(arrival)); m != nil {
+			train.Arrival, _ = clockToMinute(m)
+		}
+	}
+	if duration := findDescendantWithClass(n, trainDurationClass); duration != nil {
+		train.Duration = parseTripDuration(getTextContent(duration))
+	}
+	if prices := findDescendantWithClass(n, trainPricesClass); prices != nil {
+		for _, carriageType := range carriageTypes {
+			table, ok := grandtrainTables[carriageType]
+			if !ok {
+				continue
+			}
+			if priceSpan := findChildWithAttribute(prices, "span", "data-table", table); priceSpan != nil {
+				train.ClassPrices = append(train.ClassPrices, ClassPrice{Class: carriageType, Price: parsePrice(getTextContent(priceSpan)), Seats: priceSeats(priceSpan), FreeSeats: priceFreeSeats(priceSpan)})
+			}
+		}
+	}
+	return train
+}
+
+// parseTripDuration parses "1 д 2 ч 30 мин" or "12 ч 5 м"
+func parseTripDuration(s string) time.Duration {
+	if i := strings.IndexAny(s, "0123456789"); i > 0 {
+		s = s[i:]
+	}
+	m := durationRe.FindStringSubmatch(s)
+	if m == nil {
+		return 0
+	}
+	days, _ := strconv.Atoi(m[1])
+	hours, _ := strconv.Atoi(m[2])
+	minutes, _ := strconv.Atoi(m[3])
+	return time.Duration(days)*24*time.Hour + time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute
+}
+
+func hasClass(n *html.Node, class string) bool {
+	val, ok := getAttributeValue(n, "class")
+	return ok && contains(strings.Fields(val), class)
+}
+
+// findDescendantWithClass finds the first descendant of a node with a specific class.
+func findDescendantWithClass(n *html.Node, class string) *html.Node {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && hasClass(c, class) {
+			return c
+		}
+		if found := findDescendantWithClass(c, class); found != nil {
+			return found
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseTrains(t *testing.T) {
+	trains := parseTrains(loadFixture(t, "grandtrain_trains.html"))
+
+	want := []Train{
+		{Number: "020У", Departure: 23*60 + 55, Arrival: 8 * 60, Duration: 8*time.Hour + 5*time.Minute, ClassPrices: []ClassPrice{
+			{Class: CarriageKupe, Price: rublePrice(5870), Seats: 4},
+			{Class: CarriageSV, Price: rublePrice(12400), Seats: 1},
+		}},
+		{Number: "752А", Departure: 6*60 + 50, Arrival: 10*60 + 45, Duration: 3*time.Hour + 55*time.Minute, ClassPrices: []ClassPrice{
+			{Class: CarriageSitting, Price: rublePrice(3210), Seats: 112},
+		}},
+		{Number: "104В", Departure: 19*60 + 10, Arrival: 21*60 + 40, Duration: 26*time.Hour + 30*time.Minute, ClassPrices: []ClassPrice{
+			{Class: CarriagePlackart, Price: priceSoldOut},
+			{Class: CarriageKupe, Price: rublePrice(4300), Seats: 9},
+		}},
+	}
+	if len(trains) != len(want) {
+		t.Fatalf("got %d trains, want %d", len(trains), len(want))
+	}
+	for i, train := range trains {
+		w := want[i]
+		if train.Number != w.Number || train.Departure != w.Departure || train.Arrival != w.Arrival || train.Duration != w.Duration {
+			t.Errorf("train %d = %+v, want %+v", i, train, w)
+		}
+		if !slices.EqualFunc(train.ClassPrices, w.ClassPrices, func(a, b ClassPrice) bool {
+			return a.Class == b.Class && a.Price == b.Price && a.Seats == b.Seats
+		}) {
+			t.Errorf("train %d prices = %+v, want %+v", i, train.ClassPrices, w.ClassPrices)
+		}
+	}
+}
+
+func TestFilteredPrice(t *testing.T) {
+	trains := parseTrains(loadFixture(t, "grandtrain_trains.html"))
+	kupe := Form{CarriageType: CarriageKupe, CompartmentNumber: allCompartments(CarriageKupe), ShelfType: ShelfAny}
+
+	tests := []struct {
+		name        string
+		form        func(Form) Form
+		wantPrice   Price
+		wantNumbers []string
+	}{
+		{"no filters", func(f Form) Form { return f }, rublePrice(4300), []string{"020У", "752А", "104В"}},
+		{"night departure", func(f Form) Form { f.DepartureWindow = TimeWindow{From: 22 * 60, To: 2 * 60}; return f }, rublePrice(5870), []string{"020У"}},
+		{"short trip", func(f Form) Form { f.MaxTripDuration = 10 * time.Hour; return f }, rublePrice(5870), []string{"020У", "752А"}},
+		{"train number", func(f Form) Form { f.TrainNumbers = []string{"752А"}; return f }, priceSoldOut, []string{"752А"}},
+		{"arrival window", func(f Form) Form { f.ArrivalWindow = TimeWindow{From: 12 * 60, To: 18 * 60}; return f }, priceSoldOut, []string{}},
+	}
+	for _, tt := range tests {
+		price, matching := filteredPrice(tt.form(kupe), trains)
+		numbers := []string{}
+		for _, train := range matching {
+			numbers = append(numbers, train.Number)
+		}
+		if price != tt.wantPrice || !slices.Equal(numbers, tt.wantNumbers) {
+			t.Errorf("%s: filteredPrice = %v, %v, want %v, %v", tt.name, price, numbers, tt.wantPrice, tt.wantNumbers)
+		}
+	}
+
+	if price, _ := filteredPrice(kupe, nil); price != priceNotOnSale {
+		t.Errorf("filteredPrice without trains = %v, want not on sale", price)
+	}
+}
+
+func TestParseTimeWindow(t *testing.T) {
+	tests := []struct {
+		in   string
+		want TimeWindow
+		ok   bool
+	}{
+		{"18:00-23:00", TimeWindow{From: 18 * 60, To: 23 * 60}, true},
+		{"22:00 - 2:30", TimeWindow{From: 22 * 60, To: 2*60 + 30}, true},
+		{"с 7:05 до 9:00", TimeWindow{From: 7*60 + 5, To: 9 * 60}, true},
+		{"18:00", TimeWindow{}, false},
+		{"18:00-18:00", TimeWindow{}, false},
+		{"24:00-01:00", TimeWindow{}, false},
+		{"10:60-11:00", TimeWindow{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseTimeWindow(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseTimeWindow(%q) = %v, %v, want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestTimeWindowContains(t *testing.T) {
+	day := TimeWindow{From: 18 * 60, To: 23 * 60}
+	night := TimeWindow{From: 22 * 60, To: 2 * 60}
+	tests := []struct {
+		window TimeWindow
+		minute int
+		want   bool
+	}{
+		{TimeWindow{}, 3 * 60, true},
+		{day, 18 * 60, true},
+		{day, 23 * 60, true},
+		{day, 17*60 + 59, false},
+		{day, 23*60 + 1, false},
+		{night, 23 * 60, true},
+		{night, 0, true},
+		{night, 2 * 60, true},
+		{night, 12 * 60, false},
+	}
+	for _, tt := range tests {
+		if got := tt.window.contains(tt.minute); got != tt.want {
+			t.Errorf("%v.contains(%d) = %v, want %v", tt.window, tt.minute, got, tt.want)
+		}
+	}
+}
+
+func TestParseTripDuration(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"в пути 8 ч 5 мин", 8*time.Hour + 5*time.Minute},
+		{"1 д 2 ч 30 мин", 26*time.Hour + 30*time.Minute},
+		{"12 ч 5 м", 12*time.Hour + 5*time.Minute},
+		{"45 мин", 45 * time.Minute},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := parseTripDuration(tt.in); got != tt.want {
+			t.Errorf("parseTripDuration(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
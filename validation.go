@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FieldError describes one broken invariant of a stored record
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError lists all broken invariants of a record
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	s := []string{}
+	for _, fieldError := range e {
+		s = append(s, fieldError.Error())
+	}
+	return "invalid record: " + strings.Join(s, "; ")
+}
+
+var validCommands = []string{"none", "start"}
+
+// Validate checks the invariants of a complete form
+func (f Form) Validate() error {
+	return f.validate(true)
+}
+
+// validate checks the invariants of the form. an incomplete form, that the wizard is filling, is checked
+// only for the fields already set, without the checks across fields
+func (f Form) validate(complete bool) error {
+	var errs ValidationError
+	add := func(field, format string, args ...any) {
+		errs = append(errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if f.DeparturePoint != "" || complete {
+		if _, ok := cities[f.DeparturePoint]; !ok {
+			add("DeparturePoint", "unknown city %q", f.DeparturePoint)
+		}
+	}
+	if f.ArrivalPoint != "" || complete {
+		if _, ok := cities[f.ArrivalPoint]; !ok {
+			add("ArrivalPoint", "unknown city %q", f.ArrivalPoint)
+		}
+	}
+	if complete && f.DeparturePoint == f.ArrivalPoint {
+		add("ArrivalPoint", "same as DeparturePoint")
+	}
+
+	if complete && f.DepartureDate.IsZero() {
+		add("DepartureDate", "not set")
+	}
+	if complete && !f.DepartureDateTo.IsZero() {
+		if f.DepartureDateTo.Before(f.DepartureDate) {
+			add("DepartureDateTo", "before DepartureDate")
+		} else if f.DepartureDateTo.After(f.DepartureDate.AddDate(0, 0, 13)) {
+			add("DepartureDateTo", "range is longer than 2 weeks")
+		}
+	}
+	if complete && f.RoundTrip && f.ReturnDate.Before(f.DepartureDate) {
+		add("ReturnDate", "before DepartureDate")
+	}
+	if f.RoundTripBudget < 0 {
+		add("RoundTripBudget", "negative")
+	}
+
+	if f.CarriageType != "" || complete {
+		if !contains(carriageTypes, f.CarriageType) {
+			add("CarriageType", "unknown carriage type %q", f.CarriageType)
+		}
+	}
+
+	if f.NumberOfPassengers != 0 || complete {
+		if !isValidNumberOfPassengers(f.NumberOfPassengers) {
+			add("NumberOfPassengers", "%d is not in 1..6", f.NumberOfPassengers)
+		}
+	}
+
+	if f.CompartmentNumber != nil || complete {
+		n := maxCompartment(f.CarriageType)
+		if _, ok := stringToCompartmentNumber(compartmentNumberToString(f.CompartmentNumber), n); !ok {
+			add("CompartmentNumber", "%v is not a non-empty list of distinct 1..%d", f.CompartmentNumber, n)
+		}
+	}
+
+	if f.ShelfType != "" || complete {
+		if !contains(shelfTypes, f.ShelfType) {
+			add("ShelfType", "unknown shelf type %q", f.ShelfType)
+		}
+	}
+
+	shelves := []struct {
+		field string
+		n     int
+	}{
+		{"NumberOfPassengersBottomShefl", f.NumberOfPassengersBottomShefl},
+		{"NumberOfPassengersTopShefl", f.NumberOfPassengersTopShefl},
+		{"NumberOfPassengersSideShefl", f.NumberOfPassengersSideShefl},
+	}
+	for _, shelf := range shelves {
+		if shelf.n < 0 {
+			add(shelf.field, "negative")
+		} else if complete && shelf.n > f.NumberOfPassengers {
+			add(shelf.field, "%d is more than NumberOfPassengers", shelf.n)
+		}
+	}
+	if complete && f.NumberOfPassengersSideShefl > 0 && (!hasSideBerths(f.CarriageType) || f.NoSideShefl) {
+		add("NumberOfPassengersSideShefl", "side shelves are not available")
+	}
+	if complete && f.ShelfType != ShelfAny && f.NumberOfPassengersBottomShefl+f.NumberOfPassengersTopShefl+f.NumberOfPassengersSideShefl != f.NumberOfPassengers {
+		add("ShelfType", "shelves do not add up to NumberOfPassengers")
+	}
+
+	windows := []struct {
+		field  string
+		window TimeWindow
+	}{
+		{"DepartureWindow", f.DepartureWindow},
+		{"ArrivalWindow", f.ArrivalWindow},
+	}
+	for _, w := range windows {
+		if w.window.From < 0 || w.window.From >= 24*60 || w.window.To < 0 || w.window.To >= 24*60 {
+			add(w.field, "%v is not within a day", w.window)
+		} else if w.window.isSet() && w.window.From == w.window.To {
+			add(w.field, "empty window")
+		}
+	}
+	if f.ChangeThreshold < 0 {
+		add("ChangeThreshold", "negative")
+	}
+	if f.ChangeDirection != "" && !contains(changeDirections, f.ChangeDirection) {
+		add("ChangeDirection", "unknown direction %q", f.ChangeDirection)
+	}
+	if f.PriceCeiling < 0 {
+		add("PriceCeiling", "negative")
+	}
+	if f.MaxTripDuration < 0 {
+		add("MaxTripDuration", "negative")
+	}
+	for _, number := range f.TrainNumbers {
+		if strings.TrimSpace(number) == "" {
+			add("TrainNumbers", "empty train number")
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Validate checks the invariants of the session and all its forms.
+// all but the last form are complete, the last one may be incomplete while the wizard is running
+func (s Session) Validate() error {
+	var errs ValidationError
+
+	if !contains(validCommands, s.Command) {
+		errs = append(errs, FieldError{Field: "Command", Message: fmt.Sprintf("unknown command %q", s.Command)})
+	}
+	if s.Step < 0 {
+		errs = append(errs, FieldError{Field: "Step", Message: "negative"})
+	}
+	if s.Timezone != "" {
+		if _, err := time.LoadLocation(s.Timezone); err != nil {
+			errs = append(errs, FieldError{Field: "Timezone", Message: fmt.Sprintf("unknown timezone %q", s.Timezone)})
+		}
+	}
+	if s.QuietMode != "" && !contains(quietModes, s.QuietMode) {
+		errs = append(errs, FieldError{Field: "QuietMode", Message: fmt.Sprintf("unknown mode %q", s.QuietMode)})
+	}
+	if s.DigestMode != "" && !contains(digestModes, s.DigestMode) {
+		errs = append(errs, FieldError{Field: "DigestMode", Message: fmt.Sprintf("unknown mode %q", s.DigestMode)})
+	}
+	if s.DigestMode == DigestInterval && s.DigestEvery <= 0 {
+		errs = append(errs, FieldError{Field: "DigestEvery", Message: "must be positive"})
+	}
+
+	ids := map[int]bool{}
+	for i, form := range s.Forms {
+		if ids[form.ID] {
+			errs = append(errs, FieldError{Field: fmt.Sprintf("Forms[%d].ID", i), Message: fmt.Sprintf("duplicate id %d", form.ID)})
+		}
+		ids[form.ID] = true
+
+		complete := s.Command == "none" || i != len(s.Forms)-1
+		if err := form.validate(complete); err != nil {
+			for _, fieldError := range err.(ValidationError) {
+				fieldError.Field = fmt.Sprintf("Forms[%d].%s", i, fieldError.Field)
+				errs = append(errs, fieldError)
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func contains[T comparable](l []T, item T) bool {
+	for _, element := range l {
+		if element == item {
+			return true
+		}
+	}
+	return false
+}